@@ -15,10 +15,14 @@ func main() {
 	etl := metl.New()
 
 	etl.AddRunnable("run", &command.Run{}, "Run a job", "jobname")
+	etl.AddRunnable("init", &command.Init{}, "Create a job file from a sample file", "jobname")
 	etl.AddRunnable("unlock", &command.Unlock{}, "Unlock a job", "jobname")
 	etl.AddRunnable("add", &command.Add{}, "Schedule a new job", "jobname")
 	etl.AddRunnable("status", &command.Status{}, "Display running job list")
+	etl.AddRunnable("rejects", &command.Rejects{}, "Show rows rejected by the latest run", "jobname")
+	etl.AddRunnable("detokenize", &command.Detokenize{}, "Look up the original value of a token", "table", "token")
 	etl.AddRunnable("list", &command.List{}, "List available jobs")
+	etl.AddRunnable("functions", &command.Functions{}, "List functions available to column transforms")
 	etl.AddRunnable("version", &command.Version{}, "Display version information")
 
 	etl.Init()
@@ -0,0 +1,35 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package command provides runnable commands for the cli interface.
+// Command detokenize looks up the original value of a token.
+package command
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/jwaldrip/odin/cli"
+	"job"
+)
+
+type Detokenize struct{}
+
+func (v *Detokenize) DefineFlags(c *cli.SubCommand) {
+	// empty
+}
+
+func (v *Detokenize) Run(c cli.Command) {
+	table := c.Param("table").String()
+	token := c.Param("token").String()
+
+	value, err := job.Detokenize(table, token)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.WithFields(log.Fields{
+		"table": table,
+		"token": token,
+	}).Info("Token looked up")
+	fmt.Println(value)
+}
@@ -0,0 +1,37 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package command provides runnable commands for the cli interface.
+// Command functions lists the helpers available to column transforms.
+package command
+
+import (
+	"fmt"
+	"github.com/jwaldrip/odin/cli"
+	"io"
+	"job"
+	"os"
+)
+
+type Functions struct{}
+
+func (v *Functions) DefineFlags(c *cli.SubCommand) {
+	// empty
+}
+
+func (v *Functions) Run(c cli.Command) {
+	listFunctions(os.Stdout, job.TemplateFunctions)
+}
+
+func listFunctions(w io.Writer, functions []job.TemplateFunction) {
+	fmt.Fprintln(w, "The following functions are available in column transforms:")
+	for _, f := range functions {
+		fmt.Fprintf(w, "\n%s\n    %s\n", f.Name, f.Description)
+
+		out, err := f.Run()
+		if err != nil {
+			out = "error: " + err.Error()
+		}
+		fmt.Fprintf(w, "    e.g. %s with %q => %q\n", f.Example, f.Input, out)
+	}
+}
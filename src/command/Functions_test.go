@@ -0,0 +1,28 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package command
+
+import (
+	"job"
+	"os"
+	"strings"
+)
+
+func ExampleFunctions() {
+	listFunctions(os.Stdout, []job.TemplateFunction{
+		{
+			Name:        "toUpper",
+			Description: "Convert to upper case",
+			Example:     `{{ toUpper . }}`,
+			Input:       "abc",
+			Function:    strings.ToUpper,
+		},
+	})
+
+	// Output:
+	// The following functions are available in column transforms:
+	//
+	// toUpper
+	//     Convert to upper case
+	//     e.g. {{ toUpper . }} with "abc" => "ABC"
+}
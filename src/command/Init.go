@@ -0,0 +1,87 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package command provides runnable commands for the cli interface.
+// Command init creates a job file from a sample input file.
+package command
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/jwaldrip/odin/cli"
+	"job"
+	"metl"
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+type Init struct{}
+
+func (v *Init) DefineFlags(c *cli.SubCommand) {
+	c.DefineStringFlag("sample", "", "Sample input file to infer the columns from")
+	c.DefineStringFlag("parser", "csv", "Parser to read the sample with")
+	c.DefineBoolFlag("header", false, "The sample's first row is a header")
+	c.DefineInt64Flag("skip", 0, "Number of rows to skip before the header or data")
+}
+
+func (v *Init) Run(c cli.Command) {
+	jobName := c.Param("jobname").String()
+	sample := c.Flag("sample").String()
+	if sample == "" {
+		log.Fatal("A sample file is required (--sample)")
+	}
+	sample, err := filepath.Abs(sample)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options := make(map[string]interface{})
+	if c.Flag("header").Get() == true {
+		options["header"] = true
+	}
+	if skip, ok := c.Flag("skip").Get().(int64); ok && skip > 0 {
+		options["skip"] = skip
+	}
+
+	parser, err := job.NewParser(c.Flag("parser").String(), options)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	columns, rows, err := job.InferColumns(parser, sample)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	author := ""
+	if u, err := user.Current(); err == nil {
+		author = u.Username
+	}
+
+	// Never overwrite an existing job
+	path := metl.GetJobFilePath(jobName) + ".toml"
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(0644))
+	if err != nil {
+		log.Fatal("Unable to create job file: ", err)
+	}
+	defer file.Close()
+
+	err = job.WriteJobFile(file, job.JobScaffold{
+		Name:    jobName,
+		Author:  author,
+		File:    "file://" + sample,
+		Parser:  c.Flag("parser").String(),
+		Options: options,
+		Rows:    rows,
+		Columns: columns,
+	})
+	if err != nil {
+		log.Fatal("Unable to write job file: ", err)
+	}
+
+	log.WithFields(log.Fields{
+		"file":    path,
+		"columns": len(columns),
+		"rows":    rows,
+	}).Info("Created job file")
+}
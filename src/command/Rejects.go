@@ -0,0 +1,51 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package command provides runnable commands for the cli interface.
+// Command rejects shows the rows rejected by a job's latest run, and the rows its outputs
+// failed to write.
+package command
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/jwaldrip/odin/cli"
+	"io"
+	"job"
+	"os"
+)
+
+type Rejects struct{}
+
+func (v *Rejects) DefineFlags(c *cli.SubCommand) {
+	// empty
+}
+
+func (v *Rejects) Run(c cli.Command) {
+	jobName := c.Param("jobname").String()
+
+	path, err := job.LatestRejects(jobName)
+	if err != nil {
+		fmt.Printf("%s: %s\n", jobName, err)
+	} else {
+		showRejects(path)
+	}
+
+	// Rows the outputs failed to write are kept in a file of their own
+	if path, err := job.LatestOutputRejects(jobName); err == nil {
+		showRejects(path)
+	}
+}
+
+func showRejects(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal("Unable to open rejects file: ", err)
+	}
+	defer file.Close()
+
+	log.Infof("Reading rejected rows from %s", path)
+	if _, err := io.Copy(os.Stdout, file); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -46,6 +46,10 @@ func (v *Run) Run(c cli.Command) {
 	j.Unlock()
 	j.Done(jf)
 
+	if jf.Failure != nil {
+		log.Fatal("Job failed: ", jf.Failure)
+	}
+
 	// log stats, notify of errors etc
 	// notify of any errors
 
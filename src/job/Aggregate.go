@@ -0,0 +1,227 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// AggregateColumn computes Function (sum, count, min, max, avg, first or last) over the
+// processed Column of each group and outputs it as Name.  Null values are ignored, so the
+// sum and average of a group without values are null.
+type AggregateColumn struct {
+	Name     string
+	Function string
+	Column   string
+}
+
+// Aggregator groups processed rows by a set of columns.  Only the aggregated rows, one per
+// group in order of first appearance, are output.  Rows are added from the output loop
+// only, so no locking is needed.
+type Aggregator struct {
+	groupBy []string
+	columns []AggregateColumn
+
+	groups map[string]*aggregateGroup
+	order  []*aggregateGroup
+}
+
+type aggregateGroup struct {
+	keys   []interface{}
+	values []*aggregateValue
+}
+
+type aggregateValue struct {
+	count       int
+	numbers     int
+	sum         float64
+	min, max    interface{}
+	first, last interface{}
+
+	// Decimals are also summed exactly, as long as every number is a decimal
+	decimals     *big.Rat
+	decimalScale int
+	onlyDecimals bool
+}
+
+func NewAggregator(groupBy []string, columns []AggregateColumn) (*Aggregator, error) {
+	for _, c := range columns {
+		switch c.Function {
+		case "sum", "count", "min", "max", "avg", "first", "last":
+		default:
+			return nil, fmt.Errorf("aggregate %s: unknown function %q", c.Name, c.Function)
+		}
+		if c.Column == "" && c.Function != "count" {
+			return nil, fmt.Errorf("aggregate %s: missing column", c.Name)
+		}
+	}
+
+	return &Aggregator{
+		groupBy: groupBy,
+		columns: columns,
+		groups:  make(map[string]*aggregateGroup),
+	}, nil
+}
+
+// Add includes a row in its group.
+func (a *Aggregator) Add(row RowProcessed) {
+	keys := make([]interface{}, len(a.groupBy))
+	parts := make([]string, len(a.groupBy))
+	for i, c := range a.groupBy {
+		keys[i] = row.Get(c)
+		parts[i] = formatValue(keys[i])
+	}
+	id := strings.Join(parts, "\x00")
+
+	g, ok := a.groups[id]
+	if !ok {
+		g = &aggregateGroup{
+			keys:   keys,
+			values: make([]*aggregateValue, len(a.columns)),
+		}
+		for i := range g.values {
+			g.values[i] = &aggregateValue{}
+		}
+		a.groups[id] = g
+		a.order = append(a.order, g)
+	}
+
+	for i, c := range a.columns {
+		// Null values are ignored, count without a column counts rows
+		v := row.Get(c.Column)
+		if c.Column != "" && v == nil {
+			continue
+		}
+		g.values[i].add(v)
+	}
+}
+
+func (v *aggregateValue) add(x interface{}) {
+	s := formatValue(x)
+	if v.count == 0 {
+		v.first, v.min, v.max = x, x, x
+		v.decimals, v.onlyDecimals = new(big.Rat), true
+	}
+	v.count++
+	v.last = x
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		v.numbers++
+		v.sum += f
+		v.addDecimal(x)
+	}
+	if compareValues(s, formatValue(v.min)) < 0 {
+		v.min = x
+	}
+	if compareValues(s, formatValue(v.max)) > 0 {
+		v.max = x
+	}
+}
+
+// addDecimal adds x to the exact sum, which is given up once x is not a decimal.
+func (v *aggregateValue) addDecimal(x interface{}) {
+	d, ok := x.(Decimal)
+	if !ok || !v.onlyDecimals {
+		v.onlyDecimals = false
+		return
+	}
+	r, ok := new(big.Rat).SetString(string(d))
+	if !ok {
+		v.onlyDecimals = false
+		return
+	}
+	v.decimals.Add(v.decimals, r)
+	if s := decimalScale(d); s > v.decimalScale {
+		v.decimalScale = s
+	}
+}
+
+// decimalScale is the number of decimals d has, taking its exponent into account.
+func decimalScale(d Decimal) int {
+	s := strings.ToLower(string(d))
+	exp := 0
+	if i := strings.IndexByte(s, 'e'); i >= 0 {
+		exp, _ = strconv.Atoi(s[i+1:])
+		s = s[:i]
+	}
+	scale := 0
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		scale = len(s) - i - 1
+	}
+	if scale -= exp; scale < 0 {
+		return 0
+	}
+	return scale
+}
+
+// compareValues compares numerically when both values are numbers.  Dates compare
+// correctly as text.
+func compareValues(a, b string) int {
+	x, errx := strconv.ParseFloat(a, 64)
+	y, erry := strconv.ParseFloat(b, 64)
+	if errx == nil && erry == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// Len is the number of groups.
+func (a *Aggregator) Len() int {
+	return len(a.order)
+}
+
+// Rows returns the aggregated rows.
+func (a *Aggregator) Rows() []RowProcessed {
+	rows := make([]RowProcessed, 0, len(a.order))
+	for _, g := range a.order {
+		row := NewRowProcessed()
+		for i, c := range a.groupBy {
+			row.Set(c, g.keys[i])
+		}
+		for i, c := range a.columns {
+			row.Set(c.Name, g.values[i].result(c.Function))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// result returns sums and averages as float64, except sums of decimals which are exact
+// decimals, counts as int64 and the other functions as the original value.
+func (v *aggregateValue) result(function string) interface{} {
+	switch function {
+	case "sum":
+		if v.numbers == 0 {
+			return nil
+		}
+		if v.onlyDecimals {
+			return Decimal(v.decimals.FloatString(v.decimalScale))
+		}
+		return v.sum
+	case "count":
+		return int64(v.count)
+	case "avg":
+		if v.numbers == 0 {
+			return nil
+		}
+		return v.sum / float64(v.numbers)
+	case "min":
+		return v.min
+	case "max":
+		return v.max
+	case "first":
+		return v.first
+	}
+	return v.last
+}
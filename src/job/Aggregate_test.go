@@ -0,0 +1,113 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	a, err := NewAggregator([]string{"date", "category"}, []AggregateColumn{
+		{"total", "sum", "amount"},
+		{"rows", "count", ""},
+		{"lowest", "min", "amount"},
+		{"highest", "max", "amount"},
+		{"average", "avg", "amount"},
+		{"firstName", "first", "name"},
+		{"lastName", "last", "name"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []struct {
+		category string
+		amount   float64
+		name     string
+	}{
+		{"a", 10, "x"},
+		{"b", 5, "y"},
+		{"a", 2.5, "z"},
+		{"a", 9, "w"},
+	} {
+		row := NewRowProcessed()
+		row.Set("date", "2014-10-01")
+		row.Set("category", r.category)
+		row.Set("amount", r.amount)
+		row.Set("name", r.name)
+		a.Add(row)
+	}
+
+	rows := a.Rows()
+	if len(rows) != 2 || a.Len() != 2 {
+		t.Fatalf("Expecting 2 rows, got %v", rows)
+	}
+
+	expected := map[string]interface{}{
+		"date":      "2014-10-01",
+		"category":  "a",
+		"total":     21.5,
+		"rows":      int64(3),
+		"lowest":    2.5,
+		"highest":   10.0,
+		"average":   21.5 / 3,
+		"firstName": "x",
+		"lastName":  "w",
+	}
+	for k, v := range expected {
+		if rows[0].Get(k) != v {
+			t.Errorf("%s: expecting %v, got %v", k, v, rows[0].Get(k))
+		}
+	}
+	if rows[0].Len() != len(expected) {
+		t.Errorf("Expecting %d columns, got %v", len(expected), rows[0])
+	}
+
+	if rows[1].Get("category") != "b" || rows[1].Get("total") != 5.0 {
+		t.Errorf("Unexpected second group %v", rows[1])
+	}
+}
+
+func TestAggregateSums(t *testing.T) {
+	a, _ := NewAggregator([]string{"category"}, []AggregateColumn{
+		{"total", "sum", "amount"},
+		{"average", "avg", "amount"},
+	})
+
+	for _, r := range []struct {
+		category string
+		amount   interface{}
+	}{
+		{"decimal", Decimal("0.1")},
+		{"decimal", Decimal("0.2")},
+		{"decimal", Decimal("15e-3")},
+		{"null", nil},
+		{"mixed", Decimal("0.5")},
+		{"mixed", 1.25},
+	} {
+		row := NewRowProcessed()
+		row.Set("category", r.category)
+		row.Set("amount", r.amount)
+		a.Add(row)
+	}
+
+	rows := a.Rows()
+	if v := rows[0].Get("total"); v != Decimal("0.315") {
+		t.Errorf("Expecting the exact decimal sum 0.315, got %v", v)
+	}
+	if v, a := rows[1].Get("total"), rows[1].Get("average"); v != nil || a != nil {
+		t.Errorf("Expecting null sum and average without values, got %v and %v", v, a)
+	}
+	if v := rows[2].Get("total"); v != 1.75 {
+		t.Errorf("Expecting a float sum 1.75, got %v", v)
+	}
+}
+
+func TestAggregateInvalid(t *testing.T) {
+	if _, err := NewAggregator(nil, []AggregateColumn{{"x", "median", "a"}}); err == nil {
+		t.Error("Expecting error for unknown function, got nil")
+	}
+	if _, err := NewAggregator(nil, []AggregateColumn{{"x", "sum", ""}}); err == nil {
+		t.Error("Expecting error for missing column, got nil")
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// Number of keys held in memory before spilling to disk
+	dedupeMemory = 1000000
+	// Number of spill files keys are partitioned into
+	dedupePartitions = 16
+)
+
+// Deduper drops rows with duplicate key columns.  The input is scanned once before it is
+// processed to decide which row of each key to keep, so the result does not depend on the
+// order in which the workers process rows.  Keys are spilled to disk when there are more
+// than fit in memory; the decision itself is kept as one bit per input row.
+type Deduper struct {
+	columns  []string
+	keepLast bool
+	memory   int
+	dir      string
+
+	keep []uint64
+	rows int
+}
+
+// NewDeduper creates a deduper on input columns, keeping either the "first" (default) or
+// the "last" row of each key.  Spill files are created in dir.
+func NewDeduper(columns []string, keep string, memory int, dir string) (*Deduper, error) {
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("dedupe: no key columns")
+	}
+	if keep != "" && keep != "first" && keep != "last" {
+		return nil, fmt.Errorf("dedupe: unknown keep option %q", keep)
+	}
+	if memory <= 0 {
+		memory = dedupeMemory
+	}
+
+	return &Deduper{
+		columns:  columns,
+		keepLast: keep == "last",
+		memory:   memory,
+		dir:      dir,
+	}, nil
+}
+
+// key returns the key of row, and the first key column missing from it, if any.
+func (d *Deduper) key(row RowRaw) (string, string) {
+	parts := make([]string, len(d.columns))
+	for i, c := range d.columns {
+		v, ok := row.Get(c)
+		if !ok {
+			return "", c
+		}
+		parts[i] = v
+	}
+	return strings.Join(parts, "\x00"), ""
+}
+
+// Scan reads the input file and decides which rows to keep.  It fails when a key column
+// is not in the first row, e.g. because of a typo in the configured columns.  Later rows
+// missing a key column are always kept, they are never duplicates of each other.
+func (d *Deduper) Scan(p Parser, file string) error {
+	if err := p.Open(file); err != nil {
+		return err
+	}
+	defer p.Close()
+
+	var spill *dedupeSpill
+	defer func() {
+		if spill != nil {
+			spill.remove()
+		}
+	}()
+
+	seen := make(map[string]int)
+	var incomplete []int
+	index := 0
+	for p.Next() {
+		key, missing := d.key(p.Row())
+		if missing != "" {
+			if index == 0 {
+				return fmt.Errorf("dedupe: column %q not in input", missing)
+			}
+			incomplete = append(incomplete, index)
+			index++
+			continue
+		}
+		if _, ok := seen[key]; !ok || d.keepLast {
+			seen[key] = index
+		}
+		index++
+
+		if len(seen) >= d.memory {
+			if spill == nil {
+				var err error
+				if spill, err = newDedupeSpill(d.dir); err != nil {
+					return err
+				}
+				log.WithFields(log.Fields{
+					"dir": spill.dir,
+				}).Info("Spilling dedupe keys to disk")
+			}
+			if err := spill.write(seen); err != nil {
+				return err
+			}
+			seen = make(map[string]int)
+		}
+	}
+
+	d.rows = index
+	d.keep = make([]uint64, (index+63)/64)
+	for _, i := range incomplete {
+		d.set(i)
+	}
+
+	if spill == nil {
+		for _, i := range seen {
+			d.set(i)
+		}
+		return nil
+	}
+
+	if err := spill.write(seen); err != nil {
+		return err
+	}
+	return spill.merge(d)
+}
+
+func (d *Deduper) set(index int) {
+	d.keep[index/64] |= 1 << uint(index%64)
+}
+
+// Keep reports whether the row at index (counted from 0 in input order) is to be kept.
+func (d *Deduper) Keep(index int) bool {
+	if index >= d.rows {
+		// Rows which were not scanned are never duplicates of each other
+		return true
+	}
+	return d.keep[index/64]&(1<<uint(index%64)) != 0
+}
+
+// dedupeSpill partitions keys over a set of files by hash, so each partition can later
+// be deduplicated in memory on its own.
+type dedupeSpill struct {
+	dir     string
+	files   []*os.File
+	writers []*bufio.Writer
+}
+
+func newDedupeSpill(dir string) (*dedupeSpill, error) {
+	tmp, err := ioutil.TempDir(dir, "dedupe")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &dedupeSpill{dir: tmp}
+	for i := 0; i < dedupePartitions; i++ {
+		f, err := os.Create(filepath.Join(tmp, fmt.Sprint(i)))
+		if err != nil {
+			s.remove()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+		s.writers = append(s.writers, bufio.NewWriter(f))
+	}
+	return s, nil
+}
+
+func (s *dedupeSpill) write(seen map[string]int) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	for key, index := range seen {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		w := s.writers[h.Sum32()%uint32(len(s.writers))]
+
+		n := binary.PutUvarint(buf, uint64(len(key)))
+		w.Write(buf[:n])
+		w.WriteString(key)
+		n = binary.PutUvarint(buf, uint64(index))
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *dedupeSpill) merge(d *Deduper) error {
+	for i, w := range s.writers {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		f := s.files[i]
+		if _, err := f.Seek(0, 0); err != nil {
+			return err
+		}
+
+		seen := make(map[string]int)
+		r := bufio.NewReader(f)
+		for {
+			l, err := binary.ReadUvarint(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			key := make([]byte, l)
+			if _, err := io.ReadFull(r, key); err != nil {
+				return err
+			}
+			u, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+
+			index := int(u)
+			if prev, ok := seen[string(key)]; !ok || (d.keepLast && index > prev) || (!d.keepLast && index < prev) {
+				seen[string(key)] = index
+			}
+		}
+
+		for _, index := range seen {
+			d.set(index)
+		}
+	}
+	return nil
+}
+
+func (s *dedupeSpill) remove() {
+	for _, f := range s.files {
+		f.Close()
+	}
+	os.RemoveAll(s.dir)
+}
@@ -0,0 +1,153 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var duplicatesLocation = "../../test_data/duplicates.csv"
+
+func dedupeKept(t *testing.T, keep string, memory int) []string {
+	dir, err := ioutil.TempDir("", "metl-dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := NewDeduper([]string{"id"}, keep, memory, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csv := &CSVParser{
+		Options: map[string]interface{}{"header": true},
+	}
+	if err := d.Scan(csv, duplicatesLocation); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := csv.Open(duplicatesLocation); err != nil {
+		t.Fatal(err)
+	}
+	defer csv.Close()
+
+	kept := make([]string, 0)
+	for i := 0; csv.Next(); i++ {
+		if d.Keep(i) {
+			name, _ := csv.Row().Get("name")
+			kept = append(kept, name)
+		}
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("Expecting spill files to be removed, got %d", len(files))
+	}
+	return kept
+}
+
+func TestDedupe(t *testing.T) {
+	testData := []struct {
+		n      string
+		keep   string
+		memory int
+		e      string
+	}{
+		{"first", "first", 0, "abd"},
+		{"default", "", 0, "abd"},
+		{"last", "last", 0, "def"},
+		{"first spilled", "first", 1, "abd"},
+		{"last spilled", "last", 2, "def"},
+	}
+
+	for _, d := range testData {
+		kept := ""
+		for _, k := range dedupeKept(t, d.keep, d.memory) {
+			kept += k
+		}
+		if kept != d.e {
+			t.Errorf("%s: expecting %s, got %s", d.n, d.e, kept)
+		}
+	}
+}
+
+func TestNewDeduperInvalid(t *testing.T) {
+	if _, err := NewDeduper(nil, "first", 0, ""); err == nil {
+		t.Error("Expecting error without columns, got nil")
+	}
+	if _, err := NewDeduper([]string{"id"}, "middle", 0, ""); err == nil {
+		t.Error("Expecting error for unknown keep, got nil")
+	}
+}
+
+func TestDedupeMissingColumn(t *testing.T) {
+	d, err := NewDeduper([]string{"ident"}, "first", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csv := &CSVParser{
+		Options: map[string]interface{}{"header": true},
+	}
+	if err := d.Scan(csv, duplicatesLocation); err == nil {
+		t.Error("Expecting error for a column not in the input, got nil")
+	}
+}
+
+func TestDedupeIncompleteRows(t *testing.T) {
+	d, err := NewDeduper([]string{"id"}, "first", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []map[string]string{
+		{"id": "1"},
+		{"name": "a"},
+		{"name": "b"},
+		{"id": "1"},
+	}
+	if err := d.Scan(&rowsParser{rows: rows}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := ""
+	for i := range rows {
+		if d.Keep(i) {
+			kept += "y"
+		} else {
+			kept += "n"
+		}
+	}
+	if kept != "yyyn" {
+		t.Errorf("Expecting rows missing the key to be kept, got %s", kept)
+	}
+}
+
+// rowsParser parses rows held in memory.
+type rowsParser struct {
+	rows  []map[string]string
+	index int
+}
+
+func (p *rowsParser) Open(file string) error {
+	p.index = -1
+	return nil
+}
+
+func (p *rowsParser) Close() {}
+
+func (p *rowsParser) Next() bool {
+	p.index++
+	return p.index < len(p.rows)
+}
+
+func (p *rowsParser) Row() RowRaw {
+	return Row(p.rows[p.index])
+}
+
+func (p *rowsParser) Line() int {
+	return p.index + 1
+}
@@ -0,0 +1,286 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// Documents per bulk request unless batchSize is set
+	elasticsearchBatchSize = 1000
+)
+
+// Elasticsearch indexes rows as documents with the _bulk API of Elasticsearch or
+// OpenSearch.  Requests are sent by an HTTPOutput, so batching, concurrency, retries and
+// authentication take the same options.  Documents the cluster fails to index are rejected
+// rows of the run, saved to the output reject file with the error as the reason, except
+// documents it was too busy to index, which are sent again with the same backoff.
+//
+// The action is index (default, creates or replaces), create (fails for existing ids) or
+// update (requires idColumn, with upsert creating missing documents).  With idColumn, rows
+// without an id are rejected, whatever the action, rather than indexed with an id generated
+// by the cluster.  The index may contain the placeholders {job}, {date} and {date:LAYOUT}, see FileOutput.
+//
+//	[job.outputting.options]
+//	url = "http://localhost:9200"
+//	index = "currencies-{date:2006.01}"
+//	idColumn = "id"
+//	action = "update"
+//	upsert = true
+type Elasticsearch struct {
+	*HTTPOutput
+
+	index    string
+	idColumn string
+	action   string
+	upsert   bool
+	// Documents rejected, guarded by the HTTPOutput's mutex
+	rejected uint
+}
+
+type bulkAction struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id,omitempty"`
+}
+
+type bulkUpdate struct {
+	Doc         RowProcessed `json:"doc"`
+	DocAsUpsert bool         `json:"doc_as_upsert,omitempty"`
+}
+
+type bulkResponse struct {
+	Errors bool
+	Items  []map[string]struct {
+		Status int
+		Error  json.RawMessage
+	}
+}
+
+// NewElasticsearch creates an Elasticsearch output from its options, expanding the index
+// template for a run of job at now.
+func NewElasticsearch(options map[string]interface{}, job string, dir string, now time.Time) (*Elasticsearch, error) {
+	h, err := NewHTTPOutput(options, dir)
+	if err != nil {
+		return nil, err
+	}
+	h.url = strings.TrimRight(h.url, "/") + "/_bulk"
+	h.method = "POST"
+	h.format = "ndjson"
+	if _, ok := options["batchSize"]; !ok {
+		h.batchSize = elasticsearchBatchSize
+	}
+
+	e := &Elasticsearch{
+		HTTPOutput: h,
+		action:     "index",
+	}
+	h.deliver = e.sendBulk
+
+	index, _ := options["index"].(string)
+	if index == "" {
+		return nil, fmt.Errorf("Elasticsearch output requires an index")
+	}
+	if e.index, err = expandPath(index, job, now); err != nil {
+		return nil, err
+	}
+	// Index names must be lower case
+	e.index = strings.ToLower(e.index)
+
+	e.idColumn, _ = options["idColumn"].(string)
+	e.upsert, _ = options["upsert"].(bool)
+	if a, ok := options["action"].(string); ok {
+		switch a {
+		case "index", "create":
+		case "update":
+			if e.idColumn == "" {
+				return nil, fmt.Errorf("Elasticsearch action update requires idColumn")
+			}
+		default:
+			return nil, fmt.Errorf("unknown Elasticsearch action %s, expecting index, create or update", a)
+		}
+		e.action = a
+	}
+	return e, nil
+}
+
+func (e *Elasticsearch) Open() {
+	if e.idColumn != "" && e.columns != nil && !inStrings(e.columns, e.idColumn) {
+		log.Fatalf("Elasticsearch idColumn %s is not an output column", e.idColumn)
+	}
+	log.WithFields(log.Fields{
+		"url":   e.url,
+		"index": e.index,
+	}).Info("Indexing rows in Elasticsearch")
+	e.startTimer()
+}
+
+// bulkBody creates the request body for a batch.  Rows without an id, when idColumn is set,
+// are returned as rejected.
+func (e *Elasticsearch) bulkBody(batch []RowProcessed) ([]byte, []RowProcessed, []RowProcessed, error) {
+	var b bytes.Buffer
+	sent := make([]RowProcessed, 0, len(batch))
+	missing := make([]RowProcessed, 0)
+
+	for _, row := range batch {
+		meta := bulkAction{Index: e.index}
+		if e.idColumn != "" {
+			meta.ID = formatValue(row.Get(e.idColumn))
+			if meta.ID == "" {
+				missing = append(missing, row)
+				continue
+			}
+		}
+
+		action, err := json.Marshal(map[string]bulkAction{e.action: meta})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		var doc []byte
+		if e.action == "update" {
+			doc, err = json.Marshal(bulkUpdate{Doc: row, DocAsUpsert: e.upsert})
+		} else {
+			doc, err = json.Marshal(row)
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		b.Write(action)
+		b.WriteByte('\n')
+		b.Write(doc)
+		b.WriteByte('\n')
+		sent = append(sent, row)
+	}
+	return b.Bytes(), sent, missing, nil
+}
+
+// sendBulk sends a batch, rejecting the documents which failed.  Documents the cluster was
+// too busy to index are sent again, and fail when it still is after the last retry.
+func (e *Elasticsearch) sendBulk(batch []RowProcessed) {
+	body, sent, missing, err := e.bulkBody(batch)
+	if err != nil {
+		e.reject(batch, err)
+		return
+	}
+	if len(missing) > 0 {
+		e.rejectRows(missing, fmt.Errorf("missing id in column %s", e.idColumn))
+	}
+
+	delay := e.retryDelay
+	for attempt := 0; len(sent) > 0; attempt++ {
+		res, err := e.send(body)
+		if err != nil {
+			e.reject(sent, err)
+			return
+		}
+
+		failed, busy, err := bulkErrors(res, len(sent))
+		if err != nil {
+			e.reject(sent, err)
+			return
+		}
+		if len(failed) > 0 {
+			log.Warnf("Failed to index %d of %d documents", len(failed), len(sent))
+		}
+		for i, ferr := range failed {
+			e.rejectRows([]RowProcessed{sent[i]}, ferr)
+		}
+		if len(busy) == 0 {
+			return
+		}
+
+		if attempt >= e.retries {
+			log.Warnf("Failed to index %d documents, the cluster is busy", len(busy))
+			for i, berr := range busy {
+				e.saveRejects([]RowProcessed{sent[i]}, berr)
+			}
+			return
+		}
+		retry := make([]RowProcessed, 0, len(busy))
+		for i, row := range sent {
+			if _, ok := busy[i]; ok {
+				retry = append(retry, row)
+			}
+		}
+		log.Warnf("Failed to index %d documents, the cluster is busy, retrying in %s", len(retry), delay)
+		time.Sleep(delay)
+		delay *= 2
+
+		if body, sent, _, err = e.bulkBody(retry); err != nil {
+			e.reject(retry, err)
+			return
+		}
+	}
+}
+
+// rejectRows counts documents the cluster rejected and saves them to the output reject file.
+func (e *Elasticsearch) rejectRows(rows []RowProcessed, err error) {
+	e.mutex.Lock()
+	e.rejected += uint(len(rows))
+	e.mutex.Unlock()
+	e.writeRejects(rows, err)
+}
+
+// Rejected is the number of documents which could not be indexed for their values.
+func (e *Elasticsearch) Rejected() uint {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.rejected
+}
+
+// bulkErrors parses a _bulk response, returning the errors of the failed items by their
+// position in the request.  Items the cluster was too busy to index (429, e.g. an
+// es_rejected_execution_exception) are returned separately, they may succeed later.
+func bulkErrors(body []byte, items int) (map[int]error, map[int]error, error) {
+	var res bulkResponse
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, nil, fmt.Errorf("invalid bulk response: %s", err)
+	}
+
+	failed := make(map[int]error)
+	busy := make(map[int]error)
+	if !res.Errors {
+		return failed, busy, nil
+	}
+	if len(res.Items) != items {
+		return nil, nil, fmt.Errorf("bulk response has %d items, expecting %d", len(res.Items), items)
+	}
+
+	for i, item := range res.Items {
+		for action, result := range item {
+			if result.Status < 300 {
+				continue
+			}
+			var reason struct {
+				Type   string
+				Reason string
+			}
+			var err error
+			if e := json.Unmarshal(result.Error, &reason); e != nil || reason.Type == "" {
+				err = fmt.Errorf("%s: status %d %s", action, result.Status, result.Error)
+			} else {
+				err = fmt.Errorf("%s: status %d %s: %s", action, result.Status, reason.Type, reason.Reason)
+			}
+
+			if result.Status == http.StatusTooManyRequests || reason.Type == "es_rejected_execution_exception" {
+				busy[i] = err
+			} else {
+				failed[i] = err
+			}
+		}
+	}
+	return failed, busy, nil
+}
+
+func (e *Elasticsearch) String() string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(e.url, "/_bulk"), e.index)
+}
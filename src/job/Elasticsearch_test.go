@@ -0,0 +1,239 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestElasticsearchBulkBody(t *testing.T) {
+	now := time.Date(2014, 3, 7, 0, 0, 0, 0, time.UTC)
+	rows := testRows(2)
+	rows[1].Set("id", nil)
+
+	data := []struct {
+		options map[string]interface{}
+		e       string
+		missing int
+	}{
+		{map[string]interface{}{"index": "Test-{date:2006.01}"},
+			`{"index":{"_index":"test-2014.03"}}` + "\n" + `{"id":0,"date":"2014-01-01T00:00:00Z","extra":"x"}` + "\n" +
+				`{"index":{"_index":"test-2014.03"}}` + "\n" + `{"id":null,"date":"2014-01-01T00:00:00Z","extra":"x"}` + "\n", 0},
+		{map[string]interface{}{"index": "{job}", "idColumn": "id", "action": "create"},
+			`{"create":{"_index":"test","_id":"0"}}` + "\n" + `{"id":0,"date":"2014-01-01T00:00:00Z","extra":"x"}` + "\n", 1},
+		{map[string]interface{}{"index": "test", "idColumn": "id"},
+			`{"index":{"_index":"test","_id":"0"}}` + "\n" + `{"id":0,"date":"2014-01-01T00:00:00Z","extra":"x"}` + "\n", 1},
+		{map[string]interface{}{"index": "test", "idColumn": "id", "action": "update", "upsert": true},
+			`{"update":{"_index":"test","_id":"0"}}` + "\n" + `{"doc":{"id":0,"date":"2014-01-01T00:00:00Z","extra":"x"},"doc_as_upsert":true}` + "\n", 1},
+	}
+	for _, d := range data {
+		d.options["url"] = "http://localhost:9200"
+		e, err := NewElasticsearch(d.options, "test", "", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, sent, missing, err := e.bulkBody(rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != d.e || len(missing) != d.missing || len(sent)+len(missing) != len(rows) {
+			t.Errorf("%v: expecting %s with %d missing, got %s with %d", d.options, d.e, d.missing, body, len(missing))
+		}
+	}
+}
+
+func TestBulkErrors(t *testing.T) {
+	ok := `{"took":3,"errors":false,"items":[{"index":{"status":201}}]}`
+	if failed, busy, err := bulkErrors([]byte(ok), 1); err != nil || len(failed) != 0 || len(busy) != 0 {
+		t.Errorf("Expecting no errors, got %v %v %v", failed, busy, err)
+	}
+
+	res := `{"took":3,"errors":true,"items":[
+		{"index":{"status":201}},
+		{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [date]"}}},
+		{"create":{"status":409,"error":"version conflict"}},
+		{"index":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue is full"}}}]}`
+	failed, busy, err := bulkErrors([]byte(res), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 2 ||
+		failed[1].Error() != "index: status 400 mapper_parsing_exception: failed to parse field [date]" ||
+		failed[2].Error() != `create: status 409 "version conflict"` {
+		t.Errorf("Unexpected errors %v", failed)
+	}
+	if len(busy) != 1 || busy[3].Error() != "index: status 429 es_rejected_execution_exception: queue is full" {
+		t.Errorf("Expecting the item to be retried, got %v", busy)
+	}
+
+	if _, _, err := bulkErrors([]byte(res), 2); err == nil {
+		t.Errorf("Expecting an item count error")
+	}
+	if _, _, err := bulkErrors([]byte("<html>"), 1); err == nil {
+		t.Errorf("Expecting an invalid response error")
+	}
+}
+
+func TestElasticsearchWrite(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+
+		// Documents with an odd id fail
+		items := make([]string, 0)
+		errors := false
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			scanner.Scan()
+			var doc struct{ ID int64 }
+			json.Unmarshal(scanner.Bytes(), &doc)
+			if doc.ID%2 == 1 {
+				errors = true
+				items = append(items, `{"index":{"status":400,"error":{"type":"illegal_argument_exception","reason":"odd"}}}`)
+			} else {
+				items = append(items, `{"index":{"status":201}}`)
+			}
+		}
+		fmt.Fprintf(w, `{"errors":%t,"items":[%s]}`, errors, strings.Join(items, ","))
+	}))
+	defer server.Close()
+
+	rejects, err := NewOutputRejects("test-elasticsearch-rejects", "ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(rejects.Path()))
+
+	e, err := NewElasticsearch(map[string]interface{}{
+		"url":       server.URL + "/",
+		"index":     "test",
+		"batchSize": int64(2),
+	}, "test", "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetColumns([]string{"id", "date"})
+	e.SetRejects(rejects)
+	e.Open()
+	for _, row := range testRows(5) {
+		e.Write(row)
+	}
+	e.Close()
+
+	if requests != 3 || e.Rejected() != 2 || e.Failed() != 0 {
+		t.Errorf("Expecting 3 requests and 2 rejected, got %d and %d (%d failed)", requests, e.Rejected(), e.Failed())
+	}
+
+	rejects.Close()
+	b, _ := ioutil.ReadFile(rejects.Path())
+	if c := strings.Count(string(b), "illegal_argument_exception: odd"); c != 2 {
+		t.Errorf("Expecting 2 rejected documents, got %d", c)
+	}
+}
+
+func TestElasticsearchBusy(t *testing.T) {
+	var mutex sync.Mutex
+	sent := make([]int, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		// The cluster is too busy for the first document of each request
+		items := make([]string, 0)
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			scanner.Scan()
+			if len(items) == 0 {
+				items = append(items, `{"index":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue is full"}}}`)
+			} else {
+				items = append(items, `{"index":{"status":201}}`)
+			}
+		}
+		sent = append(sent, len(items))
+		fmt.Fprintf(w, `{"errors":true,"items":[%s]}`, strings.Join(items, ","))
+	}))
+	defer server.Close()
+
+	for _, retries := range []int64{1, 0} {
+		sent = sent[:0]
+		e, _ := NewElasticsearch(map[string]interface{}{
+			"url":        server.URL,
+			"index":      "test",
+			"retries":    retries,
+			"retryDelay": int64(1),
+		}, "test", "", time.Now())
+		e.Open()
+		for _, row := range testRows(3) {
+			e.Write(row)
+		}
+		e.Close()
+
+		// Only the busy document is sent again, and fails when the cluster stays busy
+		if len(sent) != int(retries)+1 || sent[0] != 3 || e.Failed() != 1 || e.Rejected() != 0 {
+			t.Errorf("%d retries: expecting requests of 3 and 1 documents and 1 failure, got %v and %d", retries, sent, e.Failed())
+		}
+		if retries > 0 && sent[1] != 1 {
+			t.Errorf("Expecting the busy document to be sent again, got %v", sent)
+		}
+	}
+}
+
+func TestElasticsearchFlushInterval(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+		fmt.Fprint(w, `{"errors":false,"items":[]}`)
+	}))
+	defer server.Close()
+
+	e, _ := NewElasticsearch(map[string]interface{}{
+		"url":           server.URL,
+		"index":         "test",
+		"flushInterval": int64(5),
+	}, "test", "", time.Now())
+	e.Open()
+	e.Write(testRows(1)[0])
+	time.Sleep(50 * time.Millisecond)
+
+	mutex.Lock()
+	if requests != 1 {
+		t.Errorf("Expecting the row to be sent before Close, got %d requests", requests)
+	}
+	mutex.Unlock()
+	e.Close()
+}
+
+func TestNewElasticsearchOptions(t *testing.T) {
+	bad := []map[string]interface{}{
+		{"url": "http://localhost:9200"},
+		{"url": "http://localhost:9200", "index": "test", "action": "update"},
+		{"url": "http://localhost:9200", "index": "test", "action": "delete"},
+		{"url": "http://localhost:9200", "index": "{unknown}"},
+	}
+	for _, o := range bad {
+		if _, err := NewElasticsearch(o, "test", "", time.Now()); err == nil {
+			t.Errorf("%v: expecting an error", o)
+		}
+	}
+}
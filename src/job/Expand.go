@@ -0,0 +1,99 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Unpivot turns a set of wide format Columns (e.g. one column per month) into one row per
+// column, with the column name in Key and its value in Value.
+type Unpivot struct {
+	Columns []string
+	Key     string
+	Value   string
+}
+
+// Split turns a delimited list in Column into one row per list item.
+type Split struct {
+	Column    string
+	Separator string
+}
+
+// Expander creates several input rows from one before they are processed.  Unpivoting is
+// done before splitting.
+type Expander struct {
+	unpivot Unpivot
+	split   Split
+}
+
+func NewExpander(unpivot Unpivot, split Split) (*Expander, error) {
+	if len(unpivot.Columns) > 0 && (unpivot.Key == "" || unpivot.Value == "") {
+		return nil, fmt.Errorf("unpivot: key and value columns are required")
+	}
+	if split.Column != "" && split.Separator == "" {
+		split.Separator = ","
+	}
+
+	return &Expander{
+		unpivot: unpivot,
+		split:   split,
+	}, nil
+}
+
+// Expand returns the rows created from row.
+func (e *Expander) Expand(row RowRaw) []RowRaw {
+	rows := []RowRaw{row}
+	if len(e.unpivot.Columns) > 0 {
+		rows = e.doUnpivot(row)
+	}
+
+	if e.split.Column == "" {
+		return rows
+	}
+
+	split := make([]RowRaw, 0, len(rows))
+	for _, r := range rows {
+		split = append(split, e.doSplit(r)...)
+	}
+	return split
+}
+
+func (e *Expander) doUnpivot(row RowRaw) []RowRaw {
+	base := row.Clone()
+	for _, c := range e.unpivot.Columns {
+		base.RemoveColumn(c)
+	}
+
+	rows := make([]RowRaw, 0, len(e.unpivot.Columns))
+	for _, c := range e.unpivot.Columns {
+		v, ok := row.Get(c)
+		if !ok {
+			continue
+		}
+		r := base.Clone()
+		r.AddColumn(e.unpivot.Key, c)
+		r.AddColumn(e.unpivot.Value, v)
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+func (e *Expander) doSplit(row RowRaw) []RowRaw {
+	v, ok := row.Get(e.split.Column)
+	if !ok {
+		return []RowRaw{row}
+	}
+
+	parts := strings.Split(v, e.split.Separator)
+	rows := make([]RowRaw, 0, len(parts))
+	for _, p := range parts {
+		r := row.Clone()
+		r.AddColumn(e.split.Column, strings.TrimSpace(p))
+		rows = append(rows, r)
+	}
+	return rows
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"testing"
+)
+
+func TestExpandUnpivot(t *testing.T) {
+	e, err := NewExpander(Unpivot{
+		Columns: []string{"jan", "feb", "mar"},
+		Key:     "month",
+		Value:   "amount",
+	}, Split{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := e.Expand(Row{"id": "1", "jan": "10", "feb": "20"})
+	if len(rows) != 2 {
+		t.Fatalf("Expecting 2 rows, got %v", rows)
+	}
+
+	expected := []map[string]string{
+		{"id": "1", "month": "jan", "amount": "10"},
+		{"id": "1", "month": "feb", "amount": "20"},
+	}
+	for i, e := range expected {
+		m := rows[i].Map()
+		if len(m) != len(e) {
+			t.Errorf("Expecting %v, got %v", e, m)
+		}
+		for k, v := range e {
+			if m[k] != v {
+				t.Errorf("%s: expecting %s, got %v", k, v, m[k])
+			}
+		}
+	}
+}
+
+func TestExpandSplit(t *testing.T) {
+	e, err := NewExpander(Unpivot{}, Split{Column: "tags", Separator: ";"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := Row{"id": "1", "tags": "a; b;c"}
+	rows := e.Expand(original)
+	if len(rows) != 3 {
+		t.Fatalf("Expecting 3 rows, got %v", rows)
+	}
+	for i, tag := range []string{"a", "b", "c"} {
+		if v, _ := rows[i].Get("tags"); v != tag {
+			t.Errorf("Expecting %s, got %v", tag, v)
+		}
+		if v, _ := rows[i].Get("id"); v != "1" {
+			t.Errorf("Expecting 1, got %v", v)
+		}
+	}
+	if original["tags"] != "a; b;c" {
+		t.Errorf("Expecting original row to be unchanged, got %v", original)
+	}
+}
+
+func TestExpandUnpivotAndSplit(t *testing.T) {
+	e, _ := NewExpander(Unpivot{
+		Columns: []string{"a", "b"},
+		Key:     "k",
+		Value:   "v",
+	}, Split{Column: "v"})
+
+	rows := e.Expand(Row{"a": "1,2", "b": "3"})
+	if len(rows) != 3 {
+		t.Errorf("Expecting 3 rows, got %v", rows)
+	}
+}
+
+func TestNewExpanderInvalid(t *testing.T) {
+	if _, err := NewExpander(Unpivot{Columns: []string{"a"}}, Split{}); err == nil {
+		t.Error("Expecting error, got nil")
+	}
+}
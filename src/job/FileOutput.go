@@ -0,0 +1,324 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// FileOutput writes rows to a file, or STDOUT when no path is given, in one of the formats
+//
+//	csv    - comma separated, with a header row unless header = false
+//	tsv    - tab separated, with a header row unless header = false
+//	json   - a JSON array of objects
+//	ndjson - one JSON object per line
+//
+// The path may contain the placeholders {job}, {date} (2006-01-02) and {date:LAYOUT} with
+// a Go time layout, e.g. "exports/{job}-{date:20060102}.csv.gz".  Relative paths are
+// resolved from the job file's directory.  Rows are written to a temporary file next to it,
+// which is renamed to the path when the run succeeds and removed when it fails, so readers
+// never see a partial file.
+type FileOutput struct {
+	format string
+	path   string
+
+	header    bool
+	delimiter string
+	quote     string
+	gzip      bool
+
+	file     *os.File
+	gz       *gzip.Writer
+	buf      *bufio.Writer
+	columns  []string
+	started  bool
+	finished bool
+	rows     uint
+	failed   uint
+	err      error
+}
+
+var pathPlaceholder = regexp.MustCompile(`\{(\w+)(?::([^}]+))?\}`)
+
+// NewFileOutput creates a file output from its options, expanding the path template for
+// a run of job at now.
+func NewFileOutput(format string, options map[string]interface{}, job string, dir string, now time.Time) (*FileOutput, error) {
+	f := &FileOutput{
+		format: format,
+		header: true,
+		quote:  "minimal",
+	}
+
+	switch format {
+	case "csv":
+		f.delimiter = ","
+	case "tsv":
+		f.delimiter = "\t"
+	case "json", "ndjson":
+	default:
+		return nil, fmt.Errorf("unknown file format %s", format)
+	}
+
+	if h, ok := options["header"].(bool); ok {
+		f.header = h
+	}
+	if d, ok := options["delimiter"].(string); ok {
+		if len([]rune(d)) != 1 {
+			return nil, fmt.Errorf("delimiter %q must be a single character", d)
+		}
+		f.delimiter = d
+	}
+	if q, ok := options["quote"].(string); ok {
+		switch q {
+		case "minimal", "all", "none":
+			f.quote = q
+		default:
+			return nil, fmt.Errorf("unknown quote %s, expecting minimal, all or none", q)
+		}
+	}
+	f.gzip, _ = options["gzip"].(bool)
+
+	path, _ := options["path"].(string)
+	if path != "" && path != "-" {
+		var err error
+		if path, err = expandPath(path, job, now); err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		f.path = path
+	}
+	return f, nil
+}
+
+// expandPath replaces the placeholders of a path template.
+func expandPath(path string, job string, now time.Time) (string, error) {
+	var err error
+	expanded := pathPlaceholder.ReplaceAllStringFunc(path, func(s string) string {
+		m := pathPlaceholder.FindStringSubmatch(s)
+		switch m[1] {
+		case "job":
+			return job
+		case "date":
+			if m[2] != "" {
+				return now.Format(m[2])
+			}
+			return now.Format("2006-01-02")
+		}
+		err = fmt.Errorf("path %s: unknown placeholder %s", path, s)
+		return s
+	})
+	return expanded, err
+}
+
+// SetColumns sets the columns written, in order.  Without them the columns of the first
+// row are used.
+func (f *FileOutput) SetColumns(columns []string) {
+	f.columns = columns
+}
+
+func (f *FileOutput) Open() {
+	var w io.Writer = os.Stdout
+	if f.path != "" {
+		dir := filepath.Dir(f.path)
+		if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+			log.Fatal(err)
+		}
+		var err error
+		f.file, err = ioutil.TempFile(dir, "."+filepath.Base(f.path)+".tmp")
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Temporary files are only readable by their owner
+		if err := f.file.Chmod(os.FileMode(0644)); err != nil {
+			log.Fatal(err)
+		}
+		w = f.file
+	}
+
+	if f.gzip {
+		f.gz = gzip.NewWriter(w)
+		w = f.gz
+	}
+	f.buf = bufio.NewWriter(w)
+
+	// Without rows the header is still written when the columns are known
+	if f.columns != nil {
+		f.start()
+	}
+}
+
+// start writes the header, or opens the JSON array.
+func (f *FileOutput) start() {
+	f.started = true
+	switch {
+	case f.format == "json":
+		f.write("[")
+	case f.header && f.delimiter != "" && len(f.columns) > 0:
+		f.write(f.record(f.columns) + "\n")
+	}
+}
+
+func (f *FileOutput) Write(row RowProcessed) {
+	if f.columns == nil {
+		f.columns = make([]string, 0)
+		for _, k := range row.Columns {
+			f.columns = append(f.columns, k)
+		}
+	}
+	if !f.started {
+		f.start()
+	}
+
+	switch f.format {
+	case "json", "ndjson":
+		// A row which can not be encoded, e.g. with a NaN float, is skipped
+		b, err := json.Marshal(row.Select(f.columns))
+		if err != nil {
+			f.failed++
+			log.Warn("Failed to encode row: ", err)
+			return
+		}
+		f.rows++
+
+		switch {
+		case f.format == "ndjson":
+			f.write(string(b) + "\n")
+		case f.rows > 1:
+			f.write(",\n" + string(b))
+		default:
+			f.write("\n" + string(b))
+		}
+	default:
+		f.rows++
+		fields := make([]string, len(f.columns))
+		for i, c := range f.columns {
+			fields[i] = formatValue(row.Get(c))
+		}
+		f.write(f.record(fields) + "\n")
+	}
+}
+
+// write keeps the first error, nothing is written after it.  The file is removed on Close,
+// so every row written has failed.
+func (f *FileOutput) write(s string) {
+	if f.err != nil {
+		return
+	}
+	if _, f.err = f.buf.WriteString(s); f.err != nil {
+		log.Warn("Failed to write row: ", f.err)
+	}
+}
+
+// record formats a delimited record.  Minimal quoting quotes the fields containing the
+// delimiter, a quote or a line break, as encoding/csv does.
+func (f *FileOutput) record(fields []string) string {
+	quoted := make([]string, len(fields))
+	for i, v := range fields {
+		minimal := v != "" && (strings.ContainsAny(v, f.delimiter+"\"\r\n") || v[0] == ' ')
+		if f.quote == "all" || (f.quote == "minimal" && minimal) {
+			v = `"` + strings.Replace(v, `"`, `""`, -1) + `"`
+		}
+		quoted[i] = v
+	}
+	return strings.Join(quoted, f.delimiter)
+}
+
+// finish flushes everything written and closes the temporary file.
+func (f *FileOutput) finish() error {
+	if !f.started {
+		f.start()
+	}
+	if f.format == "json" {
+		if f.rows > 0 {
+			f.write("\n")
+		}
+		f.write("]\n")
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	if f.gz != nil {
+		if err := f.gz.Close(); err != nil {
+			return err
+		}
+	}
+	if f.file != nil {
+		return f.file.Close()
+	}
+	return nil
+}
+
+// Finish writes the file, which is renamed to the path on Close.  When that fails all rows
+// have failed, and the file is removed.
+func (f *FileOutput) Finish() {
+	if f.finished {
+		return
+	}
+	f.finished = true
+	if err := f.finish(); err != nil {
+		f.err = err
+		f.failed += f.rows
+		log.Warn("Failed to write file: ", err)
+		f.Rollback()
+	}
+}
+
+func (f *FileOutput) Close() {
+	f.Finish()
+	if f.err != nil {
+		return
+	}
+
+	if f.file != nil {
+		if err := os.Rename(f.file.Name(), f.path); err != nil {
+			f.failed += f.rows
+			log.Warn("Failed to write file: ", err)
+			os.Remove(f.file.Name())
+			return
+		}
+		log.Infof("Wrote %d rows to %s", f.rows, f.path)
+	}
+}
+
+// Rollback removes the temporary file, anything already written to STDOUT stays written.
+func (f *FileOutput) Rollback() {
+	if f.file != nil {
+		f.file.Close()
+		os.Remove(f.file.Name())
+		return
+	}
+	f.buf.Flush()
+	if f.gz != nil {
+		f.gz.Close()
+	}
+}
+
+// Failed is the number of rows which could not be written.
+func (f *FileOutput) Failed() uint {
+	return f.failed
+}
+
+func (f *FileOutput) String() string {
+	if f.path == "" {
+		return strings.ToUpper(f.format) + " to STDOUT"
+	}
+	return fmt.Sprintf("%s to %s", strings.ToUpper(f.format), f.path)
+}
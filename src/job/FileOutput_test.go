@@ -0,0 +1,213 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandPath(t *testing.T) {
+	now := time.Date(2014, 3, 7, 12, 30, 0, 0, time.UTC)
+
+	data := []struct {
+		path string
+		e    string
+	}{
+		{"out.csv", "out.csv"},
+		{"{job}/{date}.csv", "currencies/2014-03-07.csv"},
+		{"{job}-{date:20060102-1504}.csv.gz", "currencies-20140307-1230.csv.gz"},
+	}
+	for _, d := range data {
+		p, err := expandPath(d.path, "currencies", now)
+		if err != nil || p != d.e {
+			t.Errorf("%s: expecting %s, got %s %v", d.path, d.e, p, err)
+		}
+	}
+
+	if _, err := expandPath("{user}.csv", "currencies", now); err == nil {
+		t.Errorf("Expecting unknown placeholder error")
+	}
+}
+
+func TestFileOutputRecord(t *testing.T) {
+	fields := []string{"a", "b,c", `d"e`, " f", ""}
+
+	data := []struct {
+		quote string
+		e     string
+	}{
+		{"minimal", `a,"b,c","d""e"," f",`},
+		{"all", `"a","b,c","d""e"," f",""`},
+		{"none", `a,b,c,d"e, f,`},
+	}
+	for _, d := range data {
+		f := &FileOutput{delimiter: ",", quote: d.quote}
+		if r := f.record(fields); r != d.e {
+			t.Errorf("%s: expecting %s, got %s", d.quote, d.e, r)
+		}
+	}
+}
+
+func TestFileOutputWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	row := NewRowProcessed()
+	row.Set("date", time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC))
+	row.Set("valuta", "EUR")
+	row.Set("kurs", Decimal("8.1"))
+	row.Set("extra", nil)
+
+	data := []struct {
+		format  string
+		options map[string]interface{}
+		columns []string
+		e       string
+	}{
+		{"csv", map[string]interface{}{}, []string{"valuta", "date", "kurs"},
+			"valuta,date,kurs\nEUR,2014-01-01,8.1\nEUR,2014-01-01,8.1\n"},
+		{"tsv", map[string]interface{}{"header": false}, nil,
+			"2014-01-01\tEUR\t8.1\t\n2014-01-01\tEUR\t8.1\t\n"},
+		{"json", map[string]interface{}{}, []string{"valuta", "kurs", "extra"},
+			"[\n{\"valuta\":\"EUR\",\"kurs\":8.1,\"extra\":null},\n{\"valuta\":\"EUR\",\"kurs\":8.1,\"extra\":null}\n]\n"},
+		{"ndjson", map[string]interface{}{}, []string{"date", "kurs"},
+			"{\"date\":\"2014-01-01\",\"kurs\":8.1}\n{\"date\":\"2014-01-01\",\"kurs\":8.1}\n"},
+	}
+	for _, d := range data {
+		d.options["path"] = "{job}." + d.format
+		f, err := NewFileOutput(d.format, d.options, "test", dir, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.SetColumns(d.columns)
+		f.Open()
+		f.Write(row)
+		f.Write(row)
+		f.Close()
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, "test."+d.format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != d.e {
+			t.Errorf("%s: expecting %q, got %q", d.format, d.e, string(b))
+		}
+	}
+
+	// Nothing but the output is left in the directory
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != len(data) {
+		t.Errorf("Expecting %d files, got %d", len(data), len(files))
+	}
+}
+
+func TestFileOutputEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for format, e := range map[string]string{"csv": "a,b\n", "json": "[]\n", "ndjson": ""} {
+		f, _ := NewFileOutput(format, map[string]interface{}{"path": "empty." + format}, "test", dir, time.Now())
+		f.SetColumns([]string{"a", "b"})
+		f.Open()
+		f.Close()
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, "empty."+format))
+		if err != nil || string(b) != e {
+			t.Errorf("%s: expecting %q, got %q %v", format, e, string(b), err)
+		}
+	}
+}
+
+func TestFileOutputEncodeFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rows := make([]RowProcessed, 3)
+	for i, v := range []float64{math.NaN(), 1.5, 2.5} {
+		rows[i] = NewRowProcessed()
+		rows[i].Set("a", v)
+	}
+
+	f, _ := NewFileOutput("json", map[string]interface{}{"path": "nan.json"}, "test", dir, time.Now())
+	f.Open()
+	for _, row := range rows {
+		f.Write(row)
+	}
+	f.Close()
+
+	// Only the row which can not be encoded fails
+	b, err := ioutil.ReadFile(filepath.Join(dir, "nan.json"))
+	if err != nil || string(b) != "[\n{\"a\":1.5},\n{\"a\":2.5}\n]\n" || f.Failed() != 1 {
+		t.Errorf("Expecting 2 rows and 1 failure, got %q and %d (%v)", string(b), f.Failed(), err)
+	}
+}
+
+func TestFileOutputGzipRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	row := NewRowProcessed()
+	row.Set("a", int64(1))
+
+	options := map[string]interface{}{"path": "out/test.csv.gz", "gzip": true}
+	f, _ := NewFileOutput("csv", options, "test", dir, time.Now())
+	f.Open()
+	f.Write(row)
+	f.Rollback()
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "out")); len(files) != 0 {
+		t.Errorf("Expecting no files after rollback, got %d", len(files))
+	}
+
+	f, _ = NewFileOutput("csv", options, "test", dir, time.Now())
+	f.Open()
+	f.Write(row)
+	f.Close()
+
+	file, err := os.Open(filepath.Join(dir, "out/test.csv.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(gz)
+	if string(b) != "a\n1\n" {
+		t.Errorf("Expecting %q, got %q", "a\n1\n", string(b))
+	}
+}
+
+func TestNewFileOutputOptions(t *testing.T) {
+	bad := []map[string]interface{}{
+		{"delimiter": ";;"},
+		{"quote": "some"},
+		{"path": "{unknown}.csv"},
+	}
+	for _, o := range bad {
+		if _, err := NewFileOutput("csv", o, "test", "", time.Now()); err == nil {
+			t.Errorf("%v: expecting an error", o)
+		}
+	}
+	if _, err := NewFileOutput("xml", map[string]interface{}{}, "test", "", time.Now()); err == nil {
+		t.Errorf("Expecting unknown format error")
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filter is a compiled row filter expression, e.g.
+//
+//	country == "NO" && amount > 0
+//	raw.status != "deleted" || `COLUMN A` =~ "^[0-9]+$"
+//
+// Bare column names refer to the processed row (the mapped column names) and names
+// prefixed with "raw." to the input row.  Names containing spaces can be quoted with
+// backticks.  A bare number is always a number, so columns named by their number, as in
+// files without a header, are quoted as well, e.g. `0` (raw.0 is a name).  Comparisons
+// are numeric when both sides are numbers and string comparisons otherwise.  Supported
+// operators: == != < <= > >= =~ !~ && || ! and parentheses.
+type Filter struct {
+	expression string
+	root       filterNode
+}
+
+// NewFilter compiles a filter expression.
+func NewFilter(expression string) (*Filter, error) {
+	p := &filterParser{}
+	if err := p.tokenize(expression); err != nil {
+		return nil, err
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("filter: unexpected %q", p.tokens[p.pos].text)
+	}
+
+	return &Filter{
+		expression: expression,
+		root:       root,
+	}, nil
+}
+
+// Match reports whether a row passes the filter.
+func (f *Filter) Match(raw RowRaw, row RowProcessed) bool {
+	return truthy(f.root.eval(raw, row))
+}
+
+func (f *Filter) String() string {
+	return f.expression
+}
+
+type filterNode interface {
+	eval(raw RowRaw, row RowProcessed) interface{}
+}
+
+type filterLiteral struct {
+	value interface{}
+}
+
+func (n filterLiteral) eval(raw RowRaw, row RowProcessed) interface{} {
+	return n.value
+}
+
+type filterColumn struct {
+	name string
+	raw  bool
+}
+
+func (n filterColumn) eval(raw RowRaw, row RowProcessed) interface{} {
+	if n.raw {
+		v, _ := raw.Get(n.name)
+		return v
+	}
+	return row.Get(n.name)
+}
+
+type filterNot struct {
+	node filterNode
+}
+
+func (n filterNot) eval(raw RowRaw, row RowProcessed) interface{} {
+	return !truthy(n.node.eval(raw, row))
+}
+
+type filterLogical struct {
+	op          string
+	left, right filterNode
+}
+
+func (n filterLogical) eval(raw RowRaw, row RowProcessed) interface{} {
+	l := truthy(n.left.eval(raw, row))
+	if n.op == "&&" {
+		return l && truthy(n.right.eval(raw, row))
+	}
+	return l || truthy(n.right.eval(raw, row))
+}
+
+type filterCompare struct {
+	op          string
+	left, right filterNode
+	re          *regexp.Regexp
+}
+
+func (n filterCompare) eval(raw RowRaw, row RowProcessed) interface{} {
+	l := n.left.eval(raw, row)
+
+	switch n.op {
+	case "=~":
+		return n.re.MatchString(formatValue(l))
+	case "!~":
+		return !n.re.MatchString(formatValue(l))
+	}
+
+	r := n.right.eval(raw, row)
+
+	var c int
+	lb, lok := l.(bool)
+	rb, rok := r.(bool)
+	if lok || rok {
+		if !lok {
+			lb = truthy(l)
+		}
+		if !rok {
+			rb = truthy(r)
+		}
+		if lb != rb {
+			c = 1
+		}
+	} else {
+		c = compareValues(formatValue(l), formatValue(r))
+	}
+
+	switch n.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// truthy treats empty strings, "0" and "false" as false.
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case nil:
+		return false
+	}
+	s := formatValue(v)
+	if x, err := strconv.ParseBool(s); err == nil {
+		return x
+	}
+	return s != ""
+}
+
+type filterToken struct {
+	kind string // op, string, number, ident
+	text string
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+var filterOperators = []string{"==", "!=", "<=", ">=", "=~", "!~", "&&", "||", "<", ">", "!", "(", ")"}
+
+func (p *filterParser) tokenize(s string) error {
+	r := []rune(s)
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			var text []rune
+			for ; j < len(r) && r[j] != c; j++ {
+				if r[j] == '\\' && c != '`' && j+1 < len(r) {
+					j++
+				}
+				text = append(text, r[j])
+			}
+			if j >= len(r) {
+				return fmt.Errorf("filter: unterminated quote in %q", s)
+			}
+			kind := "string"
+			if c == '`' {
+				kind = "ident"
+			}
+			p.tokens = append(p.tokens, filterToken{kind, string(text)})
+			i = j + 1
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(r) && unicode.IsDigit(r[i+1])):
+			j := i + 1
+			for j < len(r) && (unicode.IsDigit(r[j]) || r[j] == '.') {
+				j++
+			}
+			p.tokens = append(p.tokens, filterToken{"number", string(r[i:j])})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(r) && (unicode.IsLetter(r[j]) || unicode.IsDigit(r[j]) || r[j] == '_' || r[j] == '.') {
+				j++
+			}
+			p.tokens = append(p.tokens, filterToken{"ident", string(r[i:j])})
+			i = j
+		default:
+			matched := false
+			for _, op := range filterOperators {
+				if strings.HasPrefix(string(r[i:]), op) {
+					p.tokens = append(p.tokens, filterToken{"op", op})
+					i += len([]rune(op))
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return fmt.Errorf("filter: unexpected character %q in %q", c, s)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *filterParser) peek(op string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == "op" && p.tokens[p.pos].text == op
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("||") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterLogical{"||", left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("&&") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = filterLogical{"&&", left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.peek("!") {
+		p.pos++
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{node}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *filterParser) parseCompare() (filterNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "=~", "!~"} {
+		if !p.peek(op) {
+			continue
+		}
+		p.pos++
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		node := filterCompare{op: op, left: left, right: right}
+		if op == "=~" || op == "!~" {
+			lit, ok := right.(filterLiteral)
+			if !ok {
+				return nil, fmt.Errorf("filter: %s expects a quoted regular expression", op)
+			}
+			if node.re, err = regexp.Compile(formatValue(lit.value)); err != nil {
+				return nil, err
+			}
+		}
+		return node, nil
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseOperand() (filterNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("filter: unexpected end of expression")
+	}
+
+	t := p.tokens[p.pos]
+	p.pos++
+
+	switch t.kind {
+	case "string", "number":
+		return filterLiteral{t.text}, nil
+	case "ident":
+		switch t.text {
+		case "true":
+			return filterLiteral{true}, nil
+		case "false":
+			return filterLiteral{false}, nil
+		}
+		// raw.`COLUMN A` is tokenized as "raw." followed by the quoted name
+		if t.text == "raw." && p.pos < len(p.tokens) && p.tokens[p.pos].kind == "ident" {
+			t.text += p.tokens[p.pos].text
+			p.pos++
+		}
+		if strings.HasPrefix(t.text, "raw.") {
+			return filterColumn{name: strings.TrimPrefix(t.text, "raw."), raw: true}, nil
+		}
+		return filterColumn{name: t.text}, nil
+	}
+
+	if t.text == "(" {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, fmt.Errorf("filter: missing )")
+		}
+		p.pos++
+		return node, nil
+	}
+
+	return nil, fmt.Errorf("filter: unexpected %q", t.text)
+}
@@ -0,0 +1,71 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	raw := Row{"country": "no", "status": "active", "COLUMN A": "42", "0": "7"}
+	row := NewRowProcessed()
+	row.Set("country", "NO")
+	row.Set("amount", 10.5)
+	row.Set("name", "test")
+	row.Set("empty", nil)
+	row.Set("1", "x")
+
+	testData := []struct {
+		expression string
+		e          bool
+	}{
+		{`country == "NO"`, true},
+		{`country != "NO"`, false},
+		{`amount > 0`, true},
+		{`amount > 10.6`, false},
+		{`amount >= 10.5 && amount <= 10.5`, true},
+		{`amount < 9 || country == 'NO'`, true},
+		{`!(country == "NO")`, false},
+		{`raw.country == "no"`, true},
+		{"raw.`COLUMN A` == 42", true},
+		{"raw.`0` == 7", true},
+		{"raw.0 == 7", true},
+		{`name =~ "^te"`, true},
+		{`name !~ "^te"`, false},
+		{`empty`, false},
+		{`name`, true},
+		{`missing == ""`, true},
+		{`amount > -1 && (raw.status == "deleted" || country == "NO")`, true},
+		{`name > "abc"`, true},
+		{`true`, true},
+		{"`1` == \"x\"", true},
+		{`1 == "x"`, false},
+	}
+
+	for _, d := range testData {
+		f, err := NewFilter(d.expression)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", d.expression, err)
+			continue
+		}
+		if m := f.Match(raw, row); m != d.e {
+			t.Errorf("%s: expecting %v, got %v", d.expression, d.e, m)
+		}
+	}
+}
+
+func TestFilterInvalid(t *testing.T) {
+	for _, e := range []string{
+		`country ==`,
+		`(country == "NO"`,
+		`country == "NO`,
+		`country # 1`,
+		`name =~ "("`,
+		`name =~ other`,
+		`a == b c`,
+	} {
+		if _, err := NewFilter(e); err == nil {
+			t.Errorf("%s: expecting error, got nil", e)
+		}
+	}
+}
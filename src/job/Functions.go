@@ -0,0 +1,275 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	templateFunctions = make(template.FuncMap)
+
+	// Compiled regular expressions used by regexReplace, keyed by pattern.
+	regexCache = struct {
+		sync.RWMutex
+		m map[string]*regexp.Regexp
+	}{m: make(map[string]*regexp.Regexp)}
+
+	// Parsed transform templates, keyed by template.
+	templateCache = struct {
+		sync.RWMutex
+		m map[string]*template.Template
+	}{m: make(map[string]*template.Template)}
+)
+
+// TemplateFunction describes a helper available to column transforms.
+type TemplateFunction struct {
+	Name        string
+	Description string
+	Example     string
+	Input       string
+	Function    interface{}
+}
+
+// TemplateFunctions lists every helper available in a ProcessColumn.Transform.  The piped
+// value is always the last argument, so helpers can be chained:
+// {{ . | trim | replace "," "." }}
+var TemplateFunctions = []TemplateFunction{
+	{"toUpper", "Convert to upper case", `{{ toUpper . }}`, "abc", strings.ToUpper},
+	{"toLower", "Convert to lower case", `{{ toLower . }}`, "ABC", strings.ToLower},
+	{"trim", "Remove leading and trailing white space", `{{ trim . }}`, "  abc  ", strings.TrimSpace},
+	{"replace", "Replace all occurrences of a string", `{{ replace "," "." . }}`, "1,5", tmplReplace},
+	{"regexReplace", "Replace all regular expression matches ($1 expands to the first group)", `{{ regexReplace "^0+" "" . }}`, "00042", tmplRegexReplace},
+	{"substr", "Characters from start up to end (negative end: until the end)", `{{ substr 0 3 . }}`, "abcdef", tmplSubstr},
+	{"padLeft", "Left pad to a given length", `{{ padLeft 5 "0" . }}`, "42", tmplPadLeft},
+	{"padRight", "Right pad to a given length", `{{ padRight 5 "." . }}`, "42", tmplPadRight},
+	{"split", "Split into a list by separator", `{{ index (split ";" .) 1 }}`, "a;b;c", tmplSplit},
+	{"join", "Join a list with a separator", `{{ split ";" . | join "," }}`, "a;b;c", tmplJoin},
+	{"default", "Use a default when the value is empty", `{{ default "n/a" . }}`, "", tmplDefault},
+	{"sha256", "Hex encoded SHA-256 digest", `{{ sha256 . }}`, "abc", tmplSha256},
+	{"md5", "Hex encoded MD5 digest", `{{ md5 . }}`, "abc", tmplMd5},
+	{"base64", "Base64 encode", `{{ base64 . }}`, "abc", tmplBase64},
+	{"base64Decode", "Base64 decode", `{{ base64Decode . }}`, "YWJj", tmplBase64Decode},
+	{"parseDate", "Parse a date using a Go time layout", `{{ parseDate "02.01.2006" . }}`, "24.12.2014", tmplParseDate},
+	{"formatDate", "Format a date using a Go time layout", `{{ parseDate "02.01.2006" . | formatDate "2006-01-02" }}`, "24.12.2014", tmplFormatDate},
+	{"Now", "Current time using a Go time layout", `{{ Now "2006-01-02" }}`, "", tmplNow},
+	{"add", "Add a number", `{{ add 1 . }}`, "41", tmplAdd},
+	{"sub", "Subtract a number", `{{ sub 2 . }}`, "44", tmplSub},
+	{"mul", "Multiply by a number", `{{ mul 100 . }}`, "0.42", tmplMul},
+	{"div", "Divide by a number", `{{ div 100 . }}`, "4200", tmplDiv},
+	{"round", "Round to a number of decimals", `{{ mul 1.1 . | round 2 }}`, "3.3333", tmplRound},
+	{"env", "Value of an environment variable", `{{ env "USER" }}`, "", os.Getenv},
+}
+
+func init() {
+	for _, f := range TemplateFunctions {
+		templateFunctions[f.Name] = f.Function
+	}
+}
+
+// Run executes the example transform against the example input.
+func (f TemplateFunction) Run() (string, error) {
+	return transform(f.Example, f.Input)
+}
+
+// transform parses and executes a transform template with the field value as the template data.
+func transform(tmpl string, value string) (string, error) {
+	templateCache.RLock()
+	t, ok := templateCache.m[tmpl]
+	templateCache.RUnlock()
+
+	if !ok {
+		var err error
+		t, err = template.New("fields").Funcs(templateFunctions).Parse(tmpl)
+		if err != nil {
+			return "", err
+		}
+		templateCache.Lock()
+		templateCache.m[tmpl] = t
+		templateCache.Unlock()
+	}
+
+	var nv bytes.Buffer
+	if err := t.Execute(&nv, value); err != nil {
+		return "", err
+	}
+	return nv.String(), nil
+}
+
+func tmplReplace(old, repl, s string) string {
+	return strings.Replace(s, old, repl, -1)
+}
+
+func tmplRegexReplace(pattern, repl, s string) (string, error) {
+	regexCache.RLock()
+	re, ok := regexCache.m[pattern]
+	regexCache.RUnlock()
+
+	if !ok {
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			return "", err
+		}
+		regexCache.Lock()
+		regexCache.m[pattern] = re
+		regexCache.Unlock()
+	}
+
+	return re.ReplaceAllString(s, repl), nil
+}
+
+func tmplSubstr(start, end int, s string) string {
+	r := []rune(s)
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 || end > len(r) {
+		end = len(r)
+	}
+	if start >= end {
+		return ""
+	}
+	return string(r[start:end])
+}
+
+func tmplPadLeft(length int, pad, s string) string {
+	for pad != "" && len([]rune(s)) < length {
+		s = pad + s
+	}
+	return s
+}
+
+func tmplPadRight(length int, pad, s string) string {
+	for pad != "" && len([]rune(s)) < length {
+		s = s + pad
+	}
+	return s
+}
+
+func tmplSplit(sep, s string) []string {
+	return strings.Split(s, sep)
+}
+
+func tmplJoin(sep string, s []string) string {
+	return strings.Join(s, sep)
+}
+
+func tmplDefault(def, s string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+func tmplSha256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func tmplMd5(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func tmplBase64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func tmplBase64Decode(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+func tmplParseDate(layout, s string) (time.Time, error) {
+	return time.Parse(layout, s)
+}
+
+func tmplFormatDate(layout string, t time.Time) string {
+	return t.Format(layout)
+}
+
+func tmplNow(format string) string {
+	return time.Now().Format(format)
+}
+
+func tmplAdd(a, b interface{}) (float64, error) {
+	x, y, err := toFloats(a, b)
+	return y + x, err
+}
+
+func tmplSub(a, b interface{}) (float64, error) {
+	x, y, err := toFloats(a, b)
+	return y - x, err
+}
+
+func tmplMul(a, b interface{}) (float64, error) {
+	x, y, err := toFloats(a, b)
+	return y * x, err
+}
+
+func tmplDiv(a, b interface{}) (float64, error) {
+	x, y, err := toFloats(a, b)
+	if err == nil && x == 0 {
+		err = errors.New("division by zero")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return y / x, nil
+}
+
+func tmplRound(places int, v interface{}) (float64, error) {
+	x, err := toFloat(v)
+	if err != nil {
+		return 0, err
+	}
+	p := math.Pow(10, float64(places))
+	return math.Round(x*p) / p, nil
+}
+
+func toFloats(a, b interface{}) (float64, float64, error) {
+	x, err := toFloat(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	y, err := toFloat(b)
+	return x, y, err
+}
+
+// toFloat converts template arguments (field values are strings) to a float64.
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(n), 64)
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case uint:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	}
+	return 0, fmt.Errorf("unable to use %v (%T) as a number", v, v)
+}
@@ -0,0 +1,86 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTemplateFunctionExamples(t *testing.T) {
+	for _, f := range TemplateFunctions {
+		if _, err := f.Run(); err != nil {
+			t.Errorf("%s: expecting example to run, got %v", f.Name, err)
+		}
+	}
+}
+
+func TestTemplateFunctions(t *testing.T) {
+	os.Setenv("METL_TEST_ENV", "env value")
+
+	testData := []struct {
+		tmpl string
+		v    string
+		e    string
+	}{
+		{`{{ trim . }}`, " a b ", "a b"},
+		{`{{ replace "," "." . }}`, "1,5,6", "1.5.6"},
+		{`{{ regexReplace "^0+" "" . }}`, "00042", "42"},
+		{`{{ regexReplace "(\\d+)-(\\d+)" "$2-$1" . }}`, "12-34", "34-12"},
+		{`{{ substr 1 3 . }}`, "æøåæ", "øå"},
+		{`{{ substr 2 -1 . }}`, "abcdef", "cdef"},
+		{`{{ substr 4 2 . }}`, "abcdef", ""},
+		{`{{ padLeft 5 "0" . }}`, "42", "00042"},
+		{`{{ padLeft 2 "0" . }}`, "123", "123"},
+		{`{{ padRight 4 "-" . }}`, "ab", "ab--"},
+		{`{{ index (split ";" .) 2 }}`, "a;b;c", "c"},
+		{`{{ split ";" . | join "|" }}`, "a;b;c", "a|b|c"},
+		{`{{ default "none" . }}`, "", "none"},
+		{`{{ default "none" . }}`, "some", "some"},
+		{`{{ sha256 . }}`, "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{`{{ md5 . }}`, "abc", "900150983cd24fb0d6963f7d28e17f72"},
+		{`{{ base64 . }}`, "abc", "YWJj"},
+		{`{{ base64Decode . }}`, "YWJj", "abc"},
+		{`{{ parseDate "02.01.2006" . | formatDate "2006-01-02" }}`, "24.12.2014", "2014-12-24"},
+		{`{{ add 1 . }}`, "41", "42"},
+		{`{{ sub 2 . }}`, "44", "42"},
+		{`{{ mul 100 . }}`, "0.5", "50"},
+		{`{{ div 4 . }}`, "10", "2.5"},
+		{`{{ round 2 . }}`, "3.14159", "3.14"},
+		{`{{ round 0 . }}`, "-2.5", "-3"},
+		{`{{ round 0 . }}`, "2.5", "3"},
+		{`{{ mul 2 . | add 1 }}`, "20", "41"},
+		{`{{ env "METL_TEST_ENV" }}`, "", "env value"},
+		{`{{ toUpper . | printf "%s!" }}`, "abc", "ABC!"},
+	}
+
+	for _, d := range testData {
+		v, err := transform(d.tmpl, d.v)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", d.tmpl, err)
+			continue
+		}
+		if v != d.e {
+			t.Errorf("%s: expecting %s, got %v", d.tmpl, d.e, v)
+		}
+	}
+}
+
+func TestTemplateFunctionErrors(t *testing.T) {
+	testData := []struct {
+		tmpl string
+		v    string
+	}{
+		{`{{ div 0 . }}`, "10"},
+		{`{{ add 1 . }}`, "abc"},
+		{`{{ parseDate "2006-01-02" . }}`, "24.12.2014"},
+		{`{{ regexReplace "(" "" . }}`, "abc"},
+		{`{{ base64Decode . }}`, "%%%"},
+	}
+
+	for _, d := range testData {
+		if v, err := transform(d.tmpl, d.v); err == nil {
+			t.Errorf("%s: expecting error, got %v", d.tmpl, v)
+		}
+	}
+}
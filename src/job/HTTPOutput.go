@@ -0,0 +1,372 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// Rows per request unless batchSize is set
+	httpBatchSize = 500
+	// Retries of a batch after a server error or too many requests, and the delay before
+	// the first retry, doubled for each retry
+	httpRetries    = 3
+	httpRetryDelay = time.Second
+	httpTimeout    = 30 * time.Second
+	// Length of response bodies included in errors
+	httpErrorLength = 512
+)
+
+// HTTPOutput posts rows in batches to a URL, either as a JSON array (default) or as
+// newline delimited JSON.  Batches failing with a server error (5xx) or 429 Too Many
+// Requests are retried with an exponential backoff, honouring Retry-After.  Batches which
+// still fail are saved to the output reject file.  With flushInterval set, rows are also
+// sent when they have waited that long for a full batch.
+//
+//	[job.outputting.options]
+//	url = "https://ingest.example.com/v1/currencies"
+//	format = "ndjson"
+//	batchSize = 500
+//	concurrency = 2
+//	auth = "env:INGEST_TOKEN"
+//	[job.outputting.options.headers]
+//	X-Source = "metl"
+type HTTPOutput struct {
+	url         string
+	method      string
+	format      string
+	headers     map[string]string
+	batchSize   int
+	concurrency int
+	retries     int
+	retryDelay  time.Duration
+	interval    time.Duration
+
+	client  *http.Client
+	rejects *Rejects
+	columns []string
+	slots   chan struct{}
+	wg      sync.WaitGroup
+	stop    chan struct{}
+	done    bool
+	// Sends a batch, replaced by outputs using another request format
+	deliver func(batch []RowProcessed)
+
+	// The batch is shared with the flush interval's timer
+	batchMutex sync.Mutex
+	batch      []RowProcessed
+
+	mutex  sync.Mutex
+	failed uint
+}
+
+// NewHTTPOutput creates an HTTP output from its options.  The auth secret, "env:NAME" or
+// "file:PATH" relative to dir, is sent as "Authorization: <authScheme> <secret>".
+func NewHTTPOutput(options map[string]interface{}, dir string) (*HTTPOutput, error) {
+	h := &HTTPOutput{
+		method:      "POST",
+		format:      "json",
+		headers:     make(map[string]string),
+		batchSize:   httpBatchSize,
+		concurrency: 1,
+		retries:     httpRetries,
+		retryDelay:  httpRetryDelay,
+		client:      &http.Client{Timeout: httpTimeout},
+	}
+
+	h.url, _ = options["url"].(string)
+	if h.url == "" {
+		return nil, fmt.Errorf("HTTP output requires a url")
+	}
+	if m, ok := options["method"].(string); ok {
+		h.method = m
+	}
+	if f, ok := options["format"].(string); ok {
+		if f != "json" && f != "ndjson" {
+			return nil, fmt.Errorf("unknown HTTP format %s, expecting json or ndjson", f)
+		}
+		h.format = f
+	}
+
+	if n, ok := options["batchSize"].(int64); ok && n > 0 {
+		h.batchSize = int(n)
+	}
+	if n, ok := options["concurrency"].(int64); ok && n > 0 {
+		h.concurrency = int(n)
+	}
+	if n, ok := options["retries"].(int64); ok && n >= 0 {
+		h.retries = int(n)
+	}
+	// Delays and timeouts are in milliseconds
+	if n, ok := options["retryDelay"].(int64); ok && n >= 0 {
+		h.retryDelay = time.Duration(n) * time.Millisecond
+	}
+	if n, ok := options["timeout"].(int64); ok && n > 0 {
+		h.client.Timeout = time.Duration(n) * time.Millisecond
+	}
+	if n, ok := options["flushInterval"].(int64); ok && n > 0 {
+		h.interval = time.Duration(n) * time.Millisecond
+	}
+
+	if headers, ok := options["headers"].(map[string]interface{}); ok {
+		for k, v := range headers {
+			h.headers[k] = fmt.Sprint(v)
+		}
+	}
+	if auth, ok := options["auth"].(string); ok {
+		secret, err := LoadSecret(auth, dir)
+		if err != nil {
+			return nil, err
+		}
+		scheme := "Bearer"
+		if s, ok := options["authScheme"].(string); ok {
+			scheme = s
+		}
+		h.headers["Authorization"] = string(secret)
+		if scheme != "" {
+			h.headers["Authorization"] = scheme + " " + string(secret)
+		}
+	}
+
+	h.slots = make(chan struct{}, h.concurrency)
+	h.deliver = h.sendBatch
+	return h, nil
+}
+
+// SetColumns sets the columns sent, in order.  Without them all columns of each row are.
+func (h *HTTPOutput) SetColumns(columns []string) {
+	h.columns = columns
+}
+
+// SetRejects sets where failed batches are saved.
+func (h *HTTPOutput) SetRejects(rejects *Rejects) {
+	h.rejects = rejects
+}
+
+func (h *HTTPOutput) Open() {
+	log.WithFields(log.Fields{
+		"url": h.url,
+	}).Info("Posting rows over HTTP")
+	h.startTimer()
+}
+
+// startTimer sends the batch every flushInterval, if set.
+func (h *HTTPOutput) startTimer() {
+	if h.interval > 0 {
+		h.stop = make(chan struct{})
+		go h.tick()
+	}
+}
+
+func (h *HTTPOutput) tick() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.batchMutex.Lock()
+			h.flush()
+			h.batchMutex.Unlock()
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+func (h *HTTPOutput) Write(row RowProcessed) {
+	if h.columns != nil {
+		row = row.Select(h.columns)
+	} else {
+		row = row.Select(row.Columns)
+	}
+
+	h.batchMutex.Lock()
+	defer h.batchMutex.Unlock()
+	h.batch = append(h.batch, row)
+	if len(h.batch) >= h.batchSize {
+		h.flush()
+	}
+}
+
+// flush sends the batch, waiting while concurrency requests are in flight.  The caller
+// holds batchMutex.
+func (h *HTTPOutput) flush() {
+	if len(h.batch) == 0 {
+		return
+	}
+	batch := h.batch
+	h.batch = nil
+
+	h.slots <- struct{}{}
+	h.wg.Add(1)
+	go func() {
+		defer func() {
+			<-h.slots
+			h.wg.Done()
+		}()
+		h.deliver(batch)
+	}()
+}
+
+func (h *HTTPOutput) sendBatch(batch []RowProcessed) {
+	body, err := h.body(batch)
+	if err == nil {
+		_, err = h.send(body)
+	}
+	if err != nil {
+		h.reject(batch, err)
+	}
+}
+
+func (h *HTTPOutput) body(batch []RowProcessed) ([]byte, error) {
+	if h.format == "json" {
+		return json.Marshal(batch)
+	}
+
+	var b bytes.Buffer
+	for _, row := range batch {
+		line, err := json.Marshal(row)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// send posts a request body, retrying server errors and rate limiting.  It returns the
+// response body.
+func (h *HTTPOutput) send(body []byte) ([]byte, error) {
+	delay := h.retryDelay
+	for attempt := 0; ; attempt++ {
+		retry, wait, res, err := h.post(body)
+		if err == nil {
+			return res, nil
+		}
+		if !retry || attempt >= h.retries {
+			return nil, err
+		}
+
+		if wait == 0 {
+			wait = delay
+			delay *= 2
+		}
+		log.Warnf("%s, retrying in %s", err, wait)
+		time.Sleep(wait)
+	}
+}
+
+// post makes a single request.  Failures which may succeed later are retried, after the
+// time the server asked for with Retry-After if it did.
+func (h *HTTPOutput) post(body []byte) (bool, time.Duration, []byte, error) {
+	req, err := http.NewRequest(h.method, h.url, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.format == "ndjson" {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return true, 0, nil, err
+	}
+	defer res.Body.Close()
+	// Read the body, so the connection can be reused
+	msg, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return true, 0, nil, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, 0, msg, nil
+	}
+
+	if len(msg) > httpErrorLength {
+		msg = msg[:httpErrorLength]
+	}
+	err = fmt.Errorf("%s %s: %s %s", h.method, h.url, res.Status, bytes.TrimSpace(msg))
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+		var wait time.Duration
+		if s, e := strconv.Atoi(res.Header.Get("Retry-After")); e == nil && s >= 0 {
+			wait = time.Duration(s) * time.Second
+		}
+		return true, wait, nil, err
+	}
+	return false, 0, nil, err
+}
+
+// reject counts a failed batch and saves its rows to the output reject file.
+func (h *HTTPOutput) reject(batch []RowProcessed, err error) {
+	log.Warnf("Failed to send %d rows: %s", len(batch), err)
+	h.saveRejects(batch, err)
+}
+
+func (h *HTTPOutput) saveRejects(batch []RowProcessed, err error) {
+	h.mutex.Lock()
+	h.failed += uint(len(batch))
+	h.mutex.Unlock()
+	h.writeRejects(batch, err)
+}
+
+// writeRejects saves rows to the output reject file, if set.
+func (h *HTTPOutput) writeRejects(batch []RowProcessed, err error) {
+	if h.rejects == nil {
+		return
+	}
+	reason := fmt.Errorf("output: %s", err)
+	for _, row := range batch {
+		h.rejects.Write(0, row.Raw(), reason)
+	}
+}
+
+// Finish sends the last batch and waits for all requests to finish.  Rows which have been
+// sent can not be taken back.
+func (h *HTTPOutput) Finish() {
+	if h.done {
+		return
+	}
+	h.done = true
+	if h.stop != nil {
+		close(h.stop)
+	}
+	h.batchMutex.Lock()
+	h.flush()
+	h.batchMutex.Unlock()
+	h.wg.Wait()
+}
+
+func (h *HTTPOutput) Close() {
+	h.Finish()
+
+	if f := h.Failed(); f > 0 {
+		log.Warnf("Failed to send %d rows to %s", f, h.url)
+	}
+}
+
+// Failed is the number of rows which could not be sent.
+func (h *HTTPOutput) Failed() uint {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.failed
+}
+
+func (h *HTTPOutput) String() string {
+	return h.url
+}
@@ -0,0 +1,239 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testRows(n int) []RowProcessed {
+	rows := make([]RowProcessed, n)
+	for i := range rows {
+		rows[i] = NewRowProcessed()
+		rows[i].Set("id", int64(i))
+		rows[i].Set("date", time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC))
+		rows[i].Set("extra", "x")
+	}
+	return rows
+}
+
+func TestHTTPOutputBatches(t *testing.T) {
+	var mutex sync.Mutex
+	bodies := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("X-Source") != "metl" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		bodies = append(bodies, string(b))
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	os.Setenv("METL_TEST_HTTP_TOKEN", "secret")
+	defer os.Unsetenv("METL_TEST_HTTP_TOKEN")
+
+	h, err := NewHTTPOutput(map[string]interface{}{
+		"url":       server.URL,
+		"batchSize": int64(2),
+		"auth":      "env:METL_TEST_HTTP_TOKEN",
+		"headers":   map[string]interface{}{"X-Source": "metl"},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetColumns([]string{"id", "date"})
+	h.Open()
+	for _, row := range testRows(5) {
+		h.Write(row)
+	}
+	h.Close()
+
+	expected := []string{
+		`[{"id":0,"date":"2014-01-01"},{"id":1,"date":"2014-01-01"}]`,
+		`[{"id":2,"date":"2014-01-01"},{"id":3,"date":"2014-01-01"}]`,
+		`[{"id":4,"date":"2014-01-01"}]`,
+	}
+	if strings.Join(bodies, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expecting %v, got %v", expected, bodies)
+	}
+	if h.Failed() != 0 {
+		t.Errorf("Expecting 0 failed rows, got %d", h.Failed())
+	}
+}
+
+func TestHTTPOutputNDJSON(t *testing.T) {
+	var body, contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		contentType = r.Header.Get("Content-Type")
+	}))
+	defer server.Close()
+
+	h, _ := NewHTTPOutput(map[string]interface{}{"url": server.URL, "format": "ndjson"}, "")
+	h.SetColumns([]string{"id"})
+	h.Open()
+	for _, row := range testRows(2) {
+		h.Write(row)
+	}
+	h.Close()
+
+	if body != "{\"id\":0}\n{\"id\":1}\n" || contentType != "application/x-ndjson" {
+		t.Errorf("Unexpected request %s %q", contentType, body)
+	}
+}
+
+func TestHTTPOutputRetries(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	h, _ := NewHTTPOutput(map[string]interface{}{"url": server.URL, "retryDelay": int64(1)}, "")
+	h.Open()
+	h.Write(testRows(1)[0])
+	h.Close()
+
+	if requests != 3 || h.Failed() != 0 {
+		t.Errorf("Expecting 3 requests and no failures, got %d and %d", requests, h.Failed())
+	}
+}
+
+func TestHTTPOutputRejects(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+		if strings.Contains(r.URL.Path, "bad") {
+			http.Error(w, "invalid rows", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	rejects, err := NewOutputRejects("test-http-rejects", "ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(rejects.Path()))
+
+	// Client errors are not retried, server errors until the retries are used up
+	data := []struct {
+		url      string
+		requests int
+	}{
+		{server.URL + "/bad", 1},
+		{server.URL + "/down", 3},
+	}
+	for _, d := range data {
+		requests = 0
+		h, _ := NewHTTPOutput(map[string]interface{}{
+			"url":        d.url,
+			"retries":    int64(2),
+			"retryDelay": int64(1),
+		}, "")
+		h.SetRejects(rejects)
+		h.Open()
+		for _, row := range testRows(2) {
+			h.Write(row)
+		}
+		h.Close()
+
+		if requests != d.requests || h.Failed() != 2 {
+			t.Errorf("%s: expecting %d requests and 2 failures, got %d and %d", d.url, d.requests, requests, h.Failed())
+		}
+	}
+
+	if err := rejects.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(rejects.Path())
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expecting 4 rejected rows, got %d", len(lines))
+	}
+	var record rejectRecord
+	json.Unmarshal([]byte(lines[0]), &record)
+	if !strings.Contains(record.Reason, "400 Bad Request invalid rows") || record.Row["date"] != "2014-01-01" {
+		t.Errorf("Unexpected rejected row %+v", record)
+	}
+}
+
+func TestHTTPOutputConcurrency(t *testing.T) {
+	var mutex sync.Mutex
+	active, max, requests := 0, 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		active++
+		requests++
+		if active > max {
+			max = active
+		}
+		mutex.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		active--
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	h, _ := NewHTTPOutput(map[string]interface{}{
+		"url":         server.URL,
+		"batchSize":   int64(1),
+		"concurrency": int64(2),
+	}, "")
+	h.Open()
+	for _, row := range testRows(6) {
+		h.Write(row)
+	}
+	h.Close()
+
+	if requests != 6 || max > 2 {
+		t.Errorf("Expecting 6 requests, at most 2 at a time, got %d and %d", requests, max)
+	}
+}
+
+func TestNewHTTPOutputOptions(t *testing.T) {
+	bad := []map[string]interface{}{
+		{},
+		{"url": "http://localhost", "format": "xml"},
+		{"url": "http://localhost", "auth": "env:METL_TEST_HTTP_MISSING"},
+	}
+	for _, o := range bad {
+		if _, err := NewHTTPOutput(o, ""); err == nil {
+			t.Errorf("%v: expecting an error", o)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// Date layouts tried when inferring date columns, in order of preference
+var inferDateLayouts = []string{
+	"2006-01-02",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05Z07:00",
+	"02.01.2006",
+	"02/01/2006",
+	"01/02/2006",
+}
+
+// InferredColumn describes a column found in a sample file.  Length is only set when all
+// values of a string column have the same length, MaxLength is the length of the longest
+// value.  Values is the number of non-empty values.
+type InferredColumn struct {
+	Name       string
+	Mapping    string
+	Type       string
+	Format     string
+	Length     int
+	MaxLength  int
+	AllowEmpty bool
+	Values     int
+}
+
+// columnGuess keeps the types which are still possible for a column.
+type columnGuess struct {
+	name    string
+	values  int
+	empty   bool
+	isInt   bool
+	isFloat bool
+	isBool  bool
+	layouts []string
+	minLen  int
+	maxLen  int
+}
+
+func newColumnGuess(name string) *columnGuess {
+	return &columnGuess{
+		name:    name,
+		isInt:   true,
+		isFloat: true,
+		isBool:  true,
+		layouts: inferDateLayouts,
+		minLen:  -1,
+	}
+}
+
+func (g *columnGuess) add(v string) {
+	if v == "" {
+		g.empty = true
+		return
+	}
+	g.values++
+
+	// Numbers padded with zeros, like zip codes and phone numbers, are text
+	if zeroPadded(v) {
+		g.isInt, g.isFloat = false, false
+	}
+	if g.isInt {
+		_, err := strconv.ParseInt(v, 10, 64)
+		g.isInt = err == nil
+	}
+	if g.isFloat {
+		// NaN and infinity are invalid floats, see parseFloat
+		_, err := parseFloat(v)
+		g.isFloat = err == nil
+	}
+	if g.isBool {
+		_, err := strconv.ParseBool(v)
+		g.isBool = err == nil
+	}
+	layouts := make([]string, 0, len(g.layouts))
+	for _, l := range g.layouts {
+		if _, err := time.Parse(l, v); err == nil {
+			layouts = append(layouts, l)
+		}
+	}
+	g.layouts = layouts
+
+	l := utf8.RuneCountInString(v)
+	if g.minLen < 0 || l < g.minLen {
+		g.minLen = l
+	}
+	if l > g.maxLen {
+		g.maxLen = l
+	}
+}
+
+func (g *columnGuess) column() InferredColumn {
+	c := InferredColumn{
+		Name:       g.name,
+		Mapping:    columnMapping(g.name),
+		Type:       "string",
+		MaxLength:  g.maxLen,
+		AllowEmpty: g.empty,
+		Values:     g.values,
+	}
+
+	// Columns without any values are strings
+	switch {
+	case g.values == 0:
+	case g.isInt:
+		c.Type = "int"
+	case g.isFloat:
+		c.Type = "float"
+	case g.isBool:
+		c.Type = "bool"
+	case len(g.layouts) > 0:
+		c.Type = "date"
+		c.Format = g.layouts[0]
+	default:
+		// A single value says nothing about the length
+		if g.minLen == g.maxLen && g.values > 1 {
+			c.Length = g.maxLen
+		}
+	}
+	return c
+}
+
+var nonWord = regexp.MustCompile(`[^a-z0-9]+`)
+
+// columnMapping creates an output column name from an input column name.
+func columnMapping(name string) string {
+	m := strings.Trim(nonWord.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if m == "" || (m[0] >= '0' && m[0] <= '9') {
+		m = "column_" + m
+	}
+	return m
+}
+
+// InferColumns reads a sample file with p and infers the type of each column.  Columns are
+// returned in the order of the parser's header, or in name order (numerically for
+// numbered columns) when it has none.
+func InferColumns(p Parser, file string) ([]InferredColumn, int, error) {
+	if err := p.Open(file); err != nil {
+		return nil, 0, err
+	}
+	defer p.Close()
+
+	guesses := make(map[string]*columnGuess)
+	rows := 0
+	for p.Next() {
+		rows++
+		for k, v := range p.Row().Map() {
+			g, ok := guesses[k]
+			if !ok {
+				g = newColumnGuess(k)
+				guesses[k] = g
+			}
+			g.add(v)
+		}
+	}
+	if rows == 0 {
+		return nil, 0, fmt.Errorf("%s: no rows found", file)
+	}
+
+	var names []string
+	if h, ok := p.(interface {
+		Header() []string
+	}); ok {
+		names = h.Header()
+	}
+	if len(names) == 0 {
+		for k := range guesses {
+			names = append(names, k)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			x, errx := strconv.Atoi(names[i])
+			y, erry := strconv.Atoi(names[j])
+			if errx == nil && erry == nil {
+				return x < y
+			}
+			return names[i] < names[j]
+		})
+	}
+
+	columns := make([]InferredColumn, 0, len(names))
+	for _, n := range names {
+		if g, ok := guesses[n]; ok {
+			c := g.column()
+			// Rows with fewer fields than others leave columns out
+			c.AllowEmpty = c.AllowEmpty || c.Values < rows
+			columns = append(columns, c)
+		}
+	}
+	return columns, rows, nil
+}
+
+// JobScaffold holds what is needed to write a new job file.
+type JobScaffold struct {
+	Name    string
+	Author  string
+	File    string
+	Parser  string
+	Options map[string]interface{}
+	Rows    int
+	Columns []InferredColumn
+}
+
+var jobTemplate = template.Must(template.New("job").Funcs(template.FuncMap{
+	"quote": tomlQuote,
+	"value": tomlValue,
+}).Parse(`name = {{ quote .Name }}
+description = "Generated from a sample of {{ .Rows }} rows, review the column rules before use"
+author = {{ quote .Author }}
+schedule = ""
+
+[job.fetching]
+file = {{ quote .File }}
+
+[job.parsing]
+engine = {{ quote .Parser }}
+{{- if .Options }}
+[job.parsing.options]
+{{- range $k, $v := .Options }}
+{{ $k }} = {{ value $v }}
+{{- end }}
+{{- end }}
+
+[job.processing]
+  workers = 3
+{{- range .Columns }}
+
+  [[job.processing.columns]]
+  name = {{ quote .Name }}
+  mapping = {{ quote .Mapping }}
+  type = {{ quote .Type }}
+{{- if .Format }}
+  format = {{ quote .Format }}
+{{- end }}
+{{- if or (ne .Type "string") .Length }}
+  failure = "reject"
+{{- end }}
+{{- if .Length }}
+  length = {{ .Length }}
+{{- else if and (eq .Type "string") .MaxLength }}
+  # longest value in the sample: {{ .MaxLength }} characters
+{{- end }}
+{{- if .AllowEmpty }}
+  allowEmpty = true
+{{- end }}
+{{- end }}
+
+[job.outputting]
+engine = "stdout"
+`))
+
+// WriteJobFile writes a job file in TOML, outputting to STDOUT until it is reviewed.
+func WriteJobFile(w io.Writer, s JobScaffold) error {
+	return jobTemplate.Execute(w, s)
+}
+
+// tomlQuote quotes a TOML basic string.
+func tomlQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, "\\u%04X", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func tomlValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return tomlQuote(s)
+	}
+	return fmt.Sprint(v)
+}
+
+// zeroPadded is true for numbers with a leading zero, e.g. "0123" but not "0" or "0.5".
+func zeroPadded(v string) bool {
+	v = strings.TrimLeft(v, "+-")
+	return len(v) > 1 && v[0] == '0' && v[1] != '.'
+}
@@ -0,0 +1,119 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"bytes"
+	"github.com/BurntSushi/toml"
+	"strings"
+	"testing"
+)
+
+func TestInferColumns(t *testing.T) {
+	p, _ := NewParser("csv", map[string]interface{}{"header": true})
+	columns, rows, err := InferColumns(p, "../../test_data/sample.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 3 {
+		t.Errorf("Expecting 3 rows, got %d", rows)
+	}
+
+	expected := []InferredColumn{
+		{Name: "id", Mapping: "id", Type: "int", MaxLength: 1, Values: 3},
+		{Name: "name", Mapping: "name", Type: "string", MaxLength: 4, Values: 3},
+		{Name: "amount", Mapping: "amount", Type: "float", MaxLength: 5, Values: 3},
+		{Name: "active", Mapping: "active", Type: "bool", MaxLength: 5, Values: 3},
+		{Name: "created", Mapping: "created", Type: "date", Format: "2006-01-02", MaxLength: 10, Values: 3},
+		{Name: "code", Mapping: "code", Type: "string", Length: 2, MaxLength: 2, Values: 3},
+		{Name: "note", Mapping: "note", Type: "string", MaxLength: 1, AllowEmpty: true, Values: 1},
+	}
+	if len(columns) != len(expected) {
+		t.Fatalf("Expecting %d columns, got %v", len(expected), columns)
+	}
+	for i, c := range expected {
+		if columns[i] != c {
+			t.Errorf("Expecting %+v, got %+v", c, columns[i])
+		}
+	}
+}
+
+func TestInferColumnsNoHeader(t *testing.T) {
+	p, _ := NewParser("csv", map[string]interface{}{"skip": int64(1)})
+	columns, _, err := InferColumns(p, "../../test_data/sample.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(columns) != 7 || columns[0].Name != "1" || columns[0].Mapping != "column_1" || columns[6].Name != "7" {
+		t.Errorf("Unexpected columns %+v", columns)
+	}
+}
+
+func TestColumnGuessZeroPadded(t *testing.T) {
+	data := []struct {
+		values []string
+		e      string
+	}{
+		{[]string{"0123", "4567"}, "string"},
+		{[]string{"1.5", "00.5"}, "string"},
+		{[]string{"0", "-0.5", "10"}, "float"},
+		{[]string{"0", "10"}, "int"},
+		{[]string{"1.5", "NaN"}, "string"},
+		{[]string{"Inf", "-Infinity"}, "string"},
+	}
+	for _, d := range data {
+		g := newColumnGuess("c")
+		for _, v := range d.values {
+			g.add(v)
+		}
+		if c := g.column(); c.Type != d.e {
+			t.Errorf("%v: expecting %s, got %s", d.values, d.e, c.Type)
+		}
+	}
+}
+
+func TestWriteJobFile(t *testing.T) {
+	p, _ := NewParser("csv", map[string]interface{}{"header": true})
+	columns, rows, _ := InferColumns(p, "../../test_data/sample.csv")
+
+	var b bytes.Buffer
+	err := WriteJobFile(&b, JobScaffold{
+		Name:    `test "sample"`,
+		File:    "file:///tmp/sample.csv",
+		Parser:  "csv",
+		Options: map[string]interface{}{"header": true},
+		Rows:    rows,
+		Columns: columns,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var j Job
+	if _, err := toml.Decode(b.String(), &j); err != nil {
+		t.Fatalf("%s\n%s", err, b.String())
+	}
+	if j.Name != `test "sample"` || j.Job.Parsing.Options["header"] != true || j.Job.Outputting.Engine != "stdout" {
+		t.Errorf("Unexpected job %s", b.String())
+	}
+	if len(j.Job.Processing.Columns) != 7 {
+		t.Fatalf("Expecting 7 columns, got %+v", j.Job.Processing.Columns)
+	}
+
+	if !strings.Contains(b.String(), "# longest value in the sample: 4 characters") {
+		t.Errorf("Expecting the longest name, got %s", b.String())
+	}
+
+	c := j.Job.Processing.Columns[4]
+	if c.Type != "date" || c.Format != "2006-01-02" || c.Failure != "reject" {
+		t.Errorf("Unexpected column %+v", c)
+	}
+	c = j.Job.Processing.Columns[5]
+	if c.Length != 2 || c.AllowEmpty || c.Failure != "reject" {
+		t.Errorf("Unexpected column %+v", c)
+	}
+	c = j.Job.Processing.Columns[6]
+	if c.Length != 0 || !c.AllowEmpty || c.Failure != "" {
+		t.Errorf("Unexpected column %+v", c)
+	}
+}
@@ -28,11 +28,17 @@ var (
 
 	// Download files to this directory
 	downloadDirectory string = "downloads"
+
+	// Maximum number of rows in flight when processing in order
+	orderedWindow = 10000
 )
 
 type Job struct {
 	StartTime time.Time `toml:"-"`
 
+	// Directory of the job file, used for resolving relative paths
+	dir string
+
 	Name        string
 	Description string
 	Author      string
@@ -54,17 +60,48 @@ type Job struct {
 		}
 		Processing struct {
 			Workers    int
+			Ordered    bool
 			AddColumns []string
 			AllowEmpty bool
-			Columns    []ProcessColumn
-		}
-		Outputting struct {
-			Engine  string
-			Options map[string]interface{}
+			NullValues []string
+			Filter     string
+			Rejects    string
+			Script     string
+			Lookups    map[string]LookupSource
+			Dedupe     struct {
+				Columns []string
+				Keep    string
+				Memory  int
+			}
+			Aggregate struct {
+				GroupBy []string
+				Columns []AggregateColumn
+			}
+			Unpivot Unpivot
+			Split   Split
+			Columns []ProcessColumn
+
+			// Failure thresholds, 0 disables the check
+			MaxRejectedPercent float64
+			MaxRejectedRows    uint
+			MinRows            uint
 		}
+		Outputting OutputConfig
+		Outputs    []OutputConfig
+
+		// Fail the run when an output fails to write rows
+		FailOnOutputError bool
 	}
 }
 
+// OutputConfig is an output engine and its options.  The name identifies the output in
+// logs and reports.
+type OutputConfig struct {
+	Name    string
+	Engine  string
+	Options map[string]interface{}
+}
+
 type Notification struct {
 	Hipchat string
 	Email   []string
@@ -78,23 +115,122 @@ type ProcessColumn struct {
 	Discard    bool
 	Failure    string
 	AllowEmpty bool
+	Default    string
+	// Time layout for date columns, defaults to 2006-01-02
+	Format string
 
 	Length         int
 	CharacterRange []string
 	Precision      int
+
+	// Replace the value using a lookup table, on a miss either "reject" (default),
+	// "keep" the value or use LookupDefault ("default")
+	Lookup        string
+	LookupMiss    string
+	LookupDefault string
+
+	// Personal data protection, applied last.  Hash replaces the value with its HMAC-SHA256
+	// using the key from "env:NAME" or "file:PATH", Tokenize with a format preserving token
+	// from the named token table.  Mask keeps the last MaskKeep characters only.
+	Hash     string
+	Tokenize string
+	Mask     bool
+	MaskKeep int
+	MaskChar string
+
+	hashKey   []byte
+	tokenizer *Tokenizer
+}
+
+// protected reports whether the column holds personal data, which is hashed, tokenized or
+// masked.
+func (c ProcessColumn) protected() bool {
+	return c.hashKey != nil || c.tokenizer != nil || c.Mask
 }
 
 type JobFile struct {
 	workers    int
+	ordered    bool
 	addColumns []string
 	Filepath   string
 	Parser     Parser
 	Mapping    ColumnMapper
+	Filter     *Filter
+	Dedupe     *Deduper
+	Expand     *Expander
+	Aggregate  *Aggregator
+	Script     *Script
+	Rejects    *Rejects
 	Output     Outputter
+	Tokenizers []*Tokenizer
 	Notify     []notifications.Notifier
-	Stats      struct {
-		Processed *Counter
-		Accepted  *Counter
+	Stats      *Stats
+	Thresholds Thresholds
+	// Rows the outputs failed to write
+	OutputRejects *Rejects
+	// Fail the run when an output fails to write rows
+	failOnOutput bool
+
+	// Set when the run failed, e.g. when a threshold was exceeded
+	Failure error
+}
+
+// Thresholds fail a run when too many rows are rejected or too few rows are received.
+type Thresholds struct {
+	MaxRejectedPercent float64
+	MaxRejectedRows    uint
+	MinRows            uint
+}
+
+// Check returns an error describing the first exceeded threshold.
+func (t Thresholds) Check(s *Stats) error {
+	rows := s.Processed.GetCount()
+	rejected := s.Rejected.GetCount()
+	// Percentages are of the rows which were processed (after expansion)
+	total := s.Accepted.GetCount() + s.Filtered.GetCount() + rejected
+
+	if t.MinRows > 0 && rows < t.MinRows {
+		return fmt.Errorf("received %d rows, expecting at least %d", rows, t.MinRows)
+	}
+	if t.MaxRejectedRows > 0 && rejected > t.MaxRejectedRows {
+		return fmt.Errorf("rejected %d rows, allowing at most %d", rejected, t.MaxRejectedRows)
+	}
+	if t.MaxRejectedPercent > 0 && total > 0 {
+		if p := float64(rejected) / float64(total) * 100; p > t.MaxRejectedPercent {
+			return fmt.Errorf("rejected %.2f%% of rows, allowing at most %.2f%%", p, t.MaxRejectedPercent)
+		}
+	}
+	return nil
+}
+
+// Stats counts rows during a run.  Processed is the number of input rows, the other
+// counters add up to the number of rows after expansion (see Expander).  Rows an output
+// rejects (see RowRejecter) are moved from accepted to rejected once the outputs are
+// finished.
+type Stats struct {
+	Processed  *Counter
+	Accepted   *Counter
+	Filtered   *Counter
+	Rejected   *Counter
+	Duplicates *Counter
+	// Invalid fields kept by their column's failure policy
+	Kept *KeyedCounter
+	// Rows the output failed to write, and by output when there are several
+	Failed        *Counter
+	FailedOutputs *KeyedCounter
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		Processed:  &Counter{},
+		Accepted:   &Counter{},
+		Filtered:   &Counter{},
+		Rejected:   &Counter{},
+		Duplicates: &Counter{},
+		Kept:       &KeyedCounter{counts: make(map[string]uint)},
+		Failed:     &Counter{},
+
+		FailedOutputs: &KeyedCounter{counts: make(map[string]uint)},
 	}
 }
 
@@ -109,12 +245,55 @@ func (c *Counter) Count() {
 	c.Unlock()
 }
 
+func (c *Counter) Add(n uint) {
+	c.Lock()
+	c.count += n
+	c.Unlock()
+}
+
+// Sub subtracts n, the count never goes below 0.
+func (c *Counter) Sub(n uint) {
+	c.Lock()
+	if n > c.count {
+		n = c.count
+	}
+	c.count -= n
+	c.Unlock()
+}
+
 func (c *Counter) GetCount() uint {
 	c.RLock()
 	defer c.RUnlock()
 	return c.count
 }
 
+// KeyedCounter counts occurrences of each key.
+type KeyedCounter struct {
+	sync.RWMutex
+	counts map[string]uint
+}
+
+func (c *KeyedCounter) Count(key string) {
+	c.Add(key, 1)
+}
+
+func (c *KeyedCounter) Add(key string, n uint) {
+	c.Lock()
+	c.counts[key] += n
+	c.Unlock()
+}
+
+// GetCounts returns a copy of the counts.
+func (c *KeyedCounter) GetCounts() map[string]uint {
+	c.RLock()
+	defer c.RUnlock()
+	counts := make(map[string]uint, len(c.counts))
+	for k, v := range c.counts {
+		counts[k] = v
+	}
+	return counts
+}
+
 func init() {
 	getLockFile = func() string {
 		return metl.Etl.GetLockFilePath()
@@ -135,10 +314,16 @@ func New(file string) *Job {
 
 	jobConfig := new(Job)
 	jobConfig.StartTime = time.Now()
+	jobConfig.dir = filepath.Dir(file)
 	if _, err := toml.DecodeFile(file+".toml", jobConfig); err != nil {
 		log.Fatal(err)
 		return nil
 	}
+	// Output names key the failed rows reported per output, so they must be unique
+	if _, err := jobConfig.OutputConfigs(); err != nil {
+		log.Fatal(err)
+		return nil
+	}
 
 	// register job's signal handling preference
 
@@ -147,15 +332,44 @@ func New(file string) *Job {
 
 func (jf *JobFile) Run() {
 	var wg sync.WaitGroup
+	defer jf.finish()
 
 	log.WithFields(log.Fields{
 		"struct":  "JobFile",
 		"func":    "Run",
 		"workers": jf.workers,
+		"ordered": jf.ordered,
 	}).Info("Starting job processing")
 
-	input := make(chan RowRaw)
-	output := make(chan RowProcessed)
+	type rawLine struct {
+		seq  int
+		line int
+		row  RowRaw
+	}
+	type result struct {
+		seq  int
+		rows []RowProcessed
+	}
+
+	input := make(chan rawLine, jf.workers)
+	output := make(chan result, jf.workers)
+
+	// In ordered mode the number of rows in flight is limited, so a slow row can not make
+	// the re-sequencing buffer grow without bounds.
+	var window chan struct{}
+	if jf.ordered {
+		window = make(chan struct{}, orderedWindow)
+	}
+
+	if jf.Dedupe != nil {
+		log.Info("Scanning for duplicate rows")
+		// Fail the run rather than exit, so the job is unlocked
+		if err := jf.Dedupe.Scan(jf.Parser, jf.Filepath); err != nil {
+			jf.Failure = err
+			log.Error("Job failed: ", jf.Failure)
+			return
+		}
+	}
 
 	wg.Add(1)
 	go func() {
@@ -165,9 +379,18 @@ func (jf *JobFile) Run() {
 		}
 		defer jf.Parser.Close()
 
-		for jf.Parser.Next() {
-			input <- jf.Parser.Row()
+		seq := 0
+		for index := 0; jf.Parser.Next(); index++ {
 			jf.Stats.Processed.Count()
+			if jf.Dedupe != nil && !jf.Dedupe.Keep(index) {
+				jf.Stats.Duplicates.Count()
+				continue
+			}
+			if window != nil {
+				window <- struct{}{}
+			}
+			input <- rawLine{seq, jf.Parser.Line(), jf.Parser.Row()}
+			seq++
 		}
 		close(input)
 		wg.Done()
@@ -176,18 +399,11 @@ func (jf *JobFile) Run() {
 	for i := 0; i < jf.workers; i++ {
 		wg.Add(1)
 		go func() {
-			addCols := len(jf.addColumns) > 0
-			for r := range input {
-				// @TODO - rethink this
-				if addCols {
-					for _, v := range jf.addColumns {
-						r.AddColumn(v, "")
-					}
-				}
-				row := r.Process(&jf.Mapping)
-				if row != nil {
-					output <- row
-					jf.Stats.Accepted.Count()
+			for in := range input {
+				rows := jf.process(in.line, in.row)
+				// The sequencer needs every result, even empty ones
+				if jf.ordered || len(rows) > 0 {
+					output <- result{in.seq, rows}
 				}
 			}
 			wg.Done()
@@ -199,11 +415,167 @@ func (jf *JobFile) Run() {
 		close(output)
 	}()
 
+	write := func(rows []RowProcessed) {
+		for _, out := range rows {
+			if jf.Aggregate != nil {
+				jf.Aggregate.Add(out)
+				continue
+			}
+			jf.Output.Write(out)
+		}
+	}
+
 	jf.Output.Open()
-	for out := range output {
-		jf.Output.Write(out)
+	if jf.ordered {
+		// Hold back results until all earlier rows have been written
+		pending := make(map[int][]RowProcessed)
+		next := 0
+		for res := range output {
+			pending[res.seq] = res.rows
+			for rows, ok := pending[next]; ok; rows, ok = pending[next] {
+				delete(pending, next)
+				write(rows)
+				<-window
+				next++
+			}
+		}
+	} else {
+		for res := range output {
+			write(res.rows)
+		}
+	}
+
+	if jf.Aggregate != nil {
+		log.Infof("Aggregated %d rows into %d rows", jf.Stats.Accepted.GetCount(), jf.Aggregate.Len())
+		for _, out := range jf.Aggregate.Rows() {
+			jf.Output.Write(out)
+		}
+	}
+
+	// Only commit the output if the run is within the configured thresholds, and no output
+	// has failed to write rows when that fails the run.  Outputs write the rows they hold
+	// back first, so their failures are known before any of them is committed.
+	if f, ok := jf.Output.(Finisher); ok {
+		f.Finish()
+	}
+	if r, ok := jf.Output.(RowRejecter); ok {
+		n := r.Rejected()
+		jf.Stats.Accepted.Sub(n)
+		jf.Stats.Rejected.Add(n)
+	}
+	jf.Failure = jf.Thresholds.Check(jf.Stats)
+	if jf.Failure == nil && jf.failOnOutput {
+		jf.Failure = outputFailure(jf.Output)
+	}
+	if a, ok := jf.Output.(Aborter); ok && jf.Failure == nil {
+		jf.Failure = a.Aborted()
+	}
+	if jf.Failure != nil {
+		log.Error("Job failed: ", jf.Failure)
+	}
+	if r, ok := jf.Output.(Rollbacker); ok && jf.Failure != nil {
+		log.Warn("Rolling back output")
+		r.Rollback()
+	} else {
+		if jf.Failure != nil {
+			log.Warnf("Output %s does not support rollback, keeping written rows", jf.Output)
+		}
+		jf.Output.Close()
+
+		// Rows can also fail while an output is committed, e.g. when a commit fails, by
+		// then the other outputs may be committed as well
+		if jf.Failure == nil && jf.failOnOutput {
+			if jf.Failure = outputFailure(jf.Output); jf.Failure != nil {
+				log.Error("Job failed: ", jf.Failure)
+			}
+		}
+	}
+	if f, ok := jf.Output.(FailureReporter); ok {
+		jf.Stats.Failed.Add(f.Failed())
+	}
+	if m, ok := jf.Output.(*MultiOutput); ok {
+		for name, n := range m.Failures() {
+			jf.Stats.FailedOutputs.Add(name, n)
+		}
+	}
+}
+
+// finish saves the reject files and closes the script and token tables, also when the run
+// failed before processing any row.
+func (jf *JobFile) finish() {
+	if err := jf.Rejects.Close(); err != nil {
+		log.Warn("Unable to save rejected rows: ", err)
+	}
+	if jf.OutputRejects != nil {
+		if err := jf.OutputRejects.Close(); err != nil {
+			log.Warn("Unable to save rows which failed to write: ", err)
+		}
+	}
+
+	if jf.Script != nil {
+		jf.Script.Close()
+	}
+
+	// Tokens are kept even when the run failed, they may already be in use elsewhere
+	for _, t := range jf.Tokenizers {
+		log.Infof("Token table %s holds %d tokens", t, t.Len())
+		t.Close()
+	}
+}
+
+// process expands, processes and filters a parsed row.  Rejected and filtered rows are
+// counted and left out of the returned rows.
+func (jf *JobFile) process(line int, r RowRaw) []RowProcessed {
+	// @TODO - rethink this
+	for _, v := range jf.addColumns {
+		r.AddColumn(v, "")
+	}
+
+	rows := []RowRaw{r}
+	if jf.Expand != nil {
+		// A row without any of the unpivot columns expands to nothing
+		if rows = jf.Expand.Expand(r); len(rows) == 0 {
+			jf.Stats.Rejected.Count()
+			jf.Rejects.Write(line, r, &RejectError{Column: "unpivot", Reason: "no unpivot columns"})
+			return nil
+		}
 	}
-	jf.Output.Close()
+
+	processed := make([]RowProcessed, 0, len(rows))
+	for _, r := range rows {
+		row, err := r.Process(&jf.Mapping)
+		if err != nil {
+			jf.Stats.Rejected.Count()
+			jf.Rejects.Write(line, r, err)
+			continue
+		}
+		for _, k := range row.kept {
+			jf.Stats.Kept.Count(k)
+		}
+
+		out := []RowProcessed{row}
+		if jf.Script != nil {
+			if out, err = jf.Script.Run(r, row); err != nil {
+				jf.Stats.Rejected.Count()
+				jf.Rejects.Write(line, r, err)
+				continue
+			}
+			if len(out) == 0 {
+				jf.Stats.Filtered.Count()
+				continue
+			}
+		}
+
+		for _, row := range out {
+			if jf.Filter != nil && !jf.Filter.Match(r, row) {
+				jf.Stats.Filtered.Count()
+				continue
+			}
+			jf.Stats.Accepted.Count()
+			processed = append(processed, row)
+		}
+	}
+	return processed
 }
 
 func (j *Job) Fetch() (*JobFile, error) {
@@ -245,31 +617,178 @@ func (j *Job) Fetch() (*JobFile, error) {
 
 	// load the processing rules
 	processor := NewColumnMap()
+	for name, source := range j.Job.Processing.Lookups {
+		lookup, err := LoadLookup(name, source, j.dir)
+		if err != nil {
+			j.Unlock()
+			log.Fatal(err)
+		}
+		processor.AddLookup(name, lookup)
+	}
+	processor.SetNullValues(j.Job.Processing.NullValues)
+	tokenizers := make(map[string]*Tokenizer)
+	protected := make([]string, 0)
 	for _, column := range j.Job.Processing.Columns {
-		column.AllowEmpty = j.Job.Processing.AllowEmpty
+		column.AllowEmpty = column.AllowEmpty || j.Job.Processing.AllowEmpty
+		if FailurePolicy(column.Failure) == "" {
+			j.Unlock()
+			log.Fatalf("Column %s has unknown failure policy %s", column.Name, column.Failure)
+		}
+		if _, ok := processor.GetLookup(column.Lookup); column.Lookup != "" && !ok {
+			j.Unlock()
+			log.Fatalf("Column %s uses undefined lookup %s", column.Name, column.Lookup)
+		}
+		if column.Hash != "" && column.Tokenize != "" {
+			j.Unlock()
+			log.Fatalf("Column %s can either be hashed or tokenized", column.Name)
+		}
+		if column.Hash != "" {
+			var err error
+			if column.hashKey, err = LoadSecret(column.Hash, j.dir); err != nil {
+				j.Unlock()
+				log.Fatalf("Column %s: %s", column.Name, err)
+			}
+		}
+		if column.Tokenize != "" {
+			if _, ok := tokenizers[column.Tokenize]; !ok {
+				t, err := OpenTokenizer(column.Tokenize)
+				if err != nil {
+					j.Unlock()
+					log.Fatalf("Column %s: %s", column.Name, err)
+				}
+				tokenizers[column.Tokenize] = t
+			}
+			column.tokenizer = tokenizers[column.Tokenize]
+		}
+		if column.protected() {
+			// A raw value would be written as it is
+			if column.Failure == "keep-raw" {
+				j.Unlock()
+				log.Fatalf("Column %s is protected, it can not keep raw values", column.Name)
+			}
+			protected = append(protected, column.Name)
+		}
 		processor.AddColumn(column)
 	}
+	// Undeclared fields have no type, so they can not be processed
+	for _, name := range j.Job.Processing.AddColumns {
+		if processor.GetColumn(name).Name == "" {
+			j.Unlock()
+			log.Fatalf("Added column %s is not declared in the columns", name)
+		}
+	}
 
-	var parser Parser
-	switch j.Job.Parsing.Engine {
-	case "csv":
-		parser = &CSVParser{
-			Options: j.Job.Parsing.Options,
+	var filter *Filter
+	if j.Job.Processing.Filter != "" {
+		var err error
+		filter, err = NewFilter(j.Job.Processing.Filter)
+		if err != nil {
+			j.Unlock()
+			log.Fatal(err)
 		}
+		log.Infof("Filtering rows on %s", filter)
 	}
-	log.Infof("Loaded %s parser", parser)
 
-	var outputter Outputter
-	switch j.Job.Outputting.Engine {
-	case "stdout":
-		outputter = &Stdout{}
-	case "mysql":
-		outputter = &Mysql{
-			Options: j.Job.Outputting.Options,
+	var dedupe *Deduper
+	if d := j.Job.Processing.Dedupe; len(d.Columns) > 0 {
+		var err error
+		dedupe, err = NewDeduper(d.Columns, d.Keep, d.Memory, getStoragePath())
+		if err != nil {
+			j.Unlock()
+			log.Fatal(err)
 		}
-	default:
+		log.Infof("Removing duplicates on %s", strings.Join(d.Columns, ", "))
+	}
+
+	var expand *Expander
+	if p := j.Job.Processing; len(p.Unpivot.Columns) > 0 || p.Split.Column != "" {
+		var err error
+		expand, err = NewExpander(p.Unpivot, p.Split)
+		if err != nil {
+			j.Unlock()
+			log.Fatal(err)
+		}
+	}
+
+	var aggregate *Aggregator
+	if a := j.Job.Processing.Aggregate; len(a.Columns) > 0 || len(a.GroupBy) > 0 {
+		var err error
+		aggregate, err = NewAggregator(a.GroupBy, a.Columns)
+		if err != nil {
+			j.Unlock()
+			log.Fatal(err)
+		}
+		log.Infof("Aggregating rows by %s", strings.Join(a.GroupBy, ", "))
+	}
+
+	var script *Script
+	if j.Job.Processing.Script != "" {
+		file := j.Job.Processing.Script
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(j.dir, file)
+		}
+		var err error
+		script, err = NewScript(file, j.Job.Processing.Workers)
+		if err != nil {
+			j.Unlock()
+			log.Fatal(err)
+		}
+		script.SetColumns(processor.Columns())
+		log.Infof("Loaded script %s", script)
+	}
+
+	rejects, err := NewRejects(j.Name, j.Job.Processing.Rejects)
+	if err != nil {
+		j.Unlock()
+		log.Fatal(err)
+	}
+	rejects.Protect(protected)
+	outputRejects, err := NewOutputRejects(j.Name, j.Job.Processing.Rejects)
+	if err != nil {
+		j.Unlock()
+		log.Fatal(err)
+	}
+
+	parser, err := NewParser(j.Job.Parsing.Engine, j.Job.Parsing.Options)
+	if err != nil {
 		j.Unlock()
-		log.Fatalf("Outputter %s does not exist", j.Job.Outputting.Engine)
+		log.Fatal(err)
+	}
+	log.Infof("Loaded %s parser", parser)
+
+	outputs := make([]Outputter, 0)
+	names := make([]string, 0)
+	configs, err := j.OutputConfigs()
+	if err != nil {
+		j.Unlock()
+		log.Fatal(err)
+	}
+	for _, o := range configs {
+		outputter, err := j.newOutputter(o)
+		if err != nil {
+			j.Unlock()
+			log.Fatal(err)
+		}
+		if c, ok := outputter.(ColumnSetter); ok {
+			c.SetColumns(j.OutputColumns())
+		}
+		if c, ok := outputter.(ColumnTyper); ok {
+			c.SetColumnTypes(j.OutputColumnTypes())
+		}
+		if r, ok := outputter.(RejectSetter); ok {
+			r.SetRejects(outputRejects)
+		}
+		outputs = append(outputs, outputter)
+		names = append(names, o.Name)
+	}
+
+	var outputter Outputter = outputs[0]
+	if len(outputs) > 1 {
+		outputter = &MultiOutput{
+			Names:   names,
+			Outputs: outputs,
+		}
+		log.Infof("Writing to %d outputs: %s", len(outputs), strings.Join(names, ", "))
 	}
 
 	notifiers := make([]notifications.Notifier, 0)
@@ -280,38 +799,218 @@ func (j *Job) Fetch() (*JobFile, error) {
 			Room:  hipparts[1],
 		})
 	}
+	if j.Notifications.Fatals.Hipchat != "" {
+		hipparts := strings.Split(j.Notifications.Fatals.Hipchat, "@")
+		notifiers = append(notifiers, &notifications.HipChat{
+			Token:       hipparts[0],
+			Room:        hipparts[1],
+			FailureOnly: true,
+		})
+	}
 
 	jf := &JobFile{
 		Filepath:   file,
 		workers:    j.Job.Processing.Workers,
+		ordered:    j.Job.Processing.Ordered,
 		addColumns: j.Job.Processing.AddColumns,
 		Parser:     parser,
 		Mapping:    processor,
+		Filter:     filter,
+		Dedupe:     dedupe,
+		Expand:     expand,
+		Aggregate:  aggregate,
+		Script:     script,
+		Rejects:    rejects,
 		Output:     outputter,
+		Tokenizers: make([]*Tokenizer, 0, len(tokenizers)),
 		Notify:     notifiers,
-		Stats: struct {
-			Processed *Counter
-			Accepted  *Counter
-		}{
-			Processed: &Counter{},
-			Accepted:  &Counter{},
+		Stats:      NewStats(),
+		Thresholds: Thresholds{
+			MaxRejectedPercent: j.Job.Processing.MaxRejectedPercent,
+			MaxRejectedRows:    j.Job.Processing.MaxRejectedRows,
+			MinRows:            j.Job.Processing.MinRows,
 		},
+		OutputRejects: outputRejects,
+		failOnOutput:  j.Job.FailOnOutputError,
+	}
+
+	for _, t := range tokenizers {
+		jf.Tokenizers = append(jf.Tokenizers, t)
 	}
 
 	return jf, nil
 }
 
+// OutputConfigs returns the outputs of the job: [job.outputting] followed by each of
+// [[job.outputs]].  Outputs without a name are named after their engine, with a number
+// added when an engine is used more than once.  Names used by more than one output, given
+// or added, are an error.
+func (j *Job) OutputConfigs() ([]OutputConfig, error) {
+	configs := make([]OutputConfig, 0, len(j.Job.Outputs)+1)
+	if j.Job.Outputting.Engine != "" || len(j.Job.Outputs) == 0 {
+		configs = append(configs, j.Job.Outputting)
+	}
+	configs = append(configs, j.Job.Outputs...)
+
+	used := make(map[string]int)
+	for i := range configs {
+		if configs[i].Name != "" {
+			continue
+		}
+		used[configs[i].Engine]++
+		configs[i].Name = configs[i].Engine
+		if n := used[configs[i].Engine]; n > 1 {
+			configs[i].Name = fmt.Sprintf("%s-%d", configs[i].Engine, n)
+		}
+	}
+
+	names := make(map[string]bool, len(configs))
+	for _, c := range configs {
+		if names[c.Name] {
+			return nil, fmt.Errorf("Output name %s is used by more than one output", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return configs, nil
+}
+
+func (j *Job) newOutputter(o OutputConfig) (Outputter, error) {
+	switch o.Engine {
+	case "stdout":
+		return &Stdout{}, nil
+	case "mysql":
+		return &Mysql{
+			Options: o.Options,
+		}, nil
+	case "postgres":
+		return &Postgres{
+			Options: o.Options,
+		}, nil
+	case "sqlite":
+		return &Sqlite{
+			Options: o.Options,
+		}, nil
+	case "csv", "tsv", "json", "ndjson":
+		return NewFileOutput(o.Engine, o.Options, j.Name, j.dir, j.StartTime)
+	case "http":
+		return NewHTTPOutput(o.Options, j.dir)
+	case "elasticsearch":
+		return NewElasticsearch(o.Options, j.Name, j.dir, j.StartTime)
+	}
+	return nil, fmt.Errorf("Outputter %s does not exist", o.Engine)
+}
+
+// OutputColumns are the columns of the output rows in order: the mapped columns which are
+// not discarded.  Added columns are declared (see Fetch), so they are among them.
+// Aggregated jobs output the group by and aggregate columns.  It is nil when scripts decide
+// the columns.
+func (j *Job) OutputColumns() []string {
+	p := j.Job.Processing
+	if p.Script != "" {
+		return nil
+	}
+
+	columns := make([]string, 0, len(p.Columns))
+	seen := make(map[string]bool)
+	add := func(c string) {
+		if c != "" && !seen[c] {
+			seen[c] = true
+			columns = append(columns, c)
+		}
+	}
+
+	if len(p.Aggregate.Columns) > 0 || len(p.Aggregate.GroupBy) > 0 {
+		for _, c := range p.Aggregate.GroupBy {
+			add(c)
+		}
+		for _, c := range p.Aggregate.Columns {
+			add(c.Name)
+		}
+		return columns
+	}
+
+	for _, c := range p.Columns {
+		if !c.Discard {
+			add(c.Mapping)
+		}
+	}
+	return columns
+}
+
+// OutputColumnTypes returns the type of the declared output columns, string when none is
+// set.  Sums and averages are floats, except sums of decimals, and counts ints, other
+// aggregates keep the type of their column.
+func (j *Job) OutputColumnTypes() map[string]string {
+	p := j.Job.Processing
+	types := make(map[string]string)
+	for _, c := range p.Columns {
+		if c.Discard || c.Mapping == "" {
+			continue
+		}
+		if _, ok := types[c.Mapping]; !ok {
+			types[c.Mapping] = c.Type
+			if c.Type == "" {
+				types[c.Mapping] = "string"
+			}
+		}
+	}
+
+	for _, c := range p.Aggregate.Columns {
+		switch c.Function {
+		case "sum", "avg":
+			types[c.Name] = "float"
+			if c.Function == "sum" && types[c.Column] == "decimal" {
+				types[c.Name] = "decimal"
+			}
+		case "count":
+			types[c.Name] = "int"
+		default:
+			if t, ok := types[c.Column]; ok {
+				types[c.Name] = t
+			}
+		}
+	}
+	return types
+}
+
 func (j *Job) Done(jf *JobFile) {
 	msg := notifications.Message{
-		Jobname:   j.Name,
-		Status:    "OK",
-		TimeTaken: time.Since(j.StartTime),
-		Rows:      jf.Stats.Processed.GetCount(),
-		Accepted:  jf.Stats.Accepted.GetCount(),
-		Rejected:  jf.Stats.Processed.GetCount() - jf.Stats.Accepted.GetCount(),
+		Jobname:    j.Name,
+		Status:     notifications.StatusOK,
+		TimeTaken:  time.Since(j.StartTime),
+		Rows:       jf.Stats.Processed.GetCount(),
+		Accepted:   jf.Stats.Accepted.GetCount(),
+		Filtered:   jf.Stats.Filtered.GetCount(),
+		Duplicates: jf.Stats.Duplicates.GetCount(),
+		Rejected:   jf.Stats.Rejected.GetCount(),
+		Kept:       jf.Stats.Kept.GetCounts(),
+		Failed:     jf.Stats.Failed.GetCount(),
+
+		FailedOutputs: jf.Stats.FailedOutputs.GetCounts(),
+	}
+	if jf.Failure != nil {
+		msg.Status = notifications.StatusFailed
+		msg.Error = jf.Failure.Error()
 	}
 
-	log.Infof("Processed %d rows: accepted %d and rejected %d in %v", msg.Rows, msg.Accepted, msg.Rejected, msg.TimeTaken)
+	log.Infof("Processed %d rows: accepted %d, filtered %d, duplicates %d and rejected %d in %v", msg.Rows, msg.Accepted, msg.Filtered, msg.Duplicates, msg.Rejected, msg.TimeTaken)
+	if msg.Failed > 0 {
+		log.Warnf("Failed to write %d rows", msg.Failed)
+	}
+	for k, v := range msg.FailedOutputs {
+		if v > 0 {
+			log.Warnf("Failed to write %d rows to %s", v, k)
+		}
+	}
+	for k, v := range msg.Kept {
+		log.Infof("Kept %d invalid fields in %s", v, k)
+	}
+	if jf.Rejects != nil && jf.Rejects.Count() > 0 {
+		log.Infof("Rejected rows saved to %s", jf.Rejects.Path())
+	}
+	if jf.OutputRejects != nil && jf.OutputRejects.Count() > 0 {
+		log.Infof("Rows which failed to write saved to %s", jf.OutputRejects.Path())
+	}
 
 	if len(jf.Notify) > 0 {
 		var wg sync.WaitGroup
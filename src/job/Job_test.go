@@ -3,11 +3,14 @@
 package job
 
 import (
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"io/ioutil"
 	"notifications"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -150,13 +153,7 @@ func TestJobDoneNotify(t *testing.T) {
 
 	jf := &JobFile{
 		Notify: []notifications.Notifier{n, n1},
-		Stats: struct {
-			Processed *Counter
-			Accepted  *Counter
-		}{
-			Processed: &Counter{},
-			Accepted:  &Counter{},
-		},
+		Stats:  NewStats(),
 	}
 
 	j.Done(jf)
@@ -169,8 +166,554 @@ func TestJobDoneNotify(t *testing.T) {
 
 type NotifyTest struct {
 	c int
+	m notifications.Message
 }
 
 func (n *NotifyTest) Notify(m notifications.Message) {
 	n.c++
+	n.m = m
+}
+
+func TestJobFileProcess(t *testing.T) {
+	cm := NewColumnMap()
+	cm.AddColumn(ProcessColumn{Name: "id", Mapping: "id", Type: "int", Failure: "reject"})
+	cm.AddColumn(ProcessColumn{Name: "tag", Mapping: "tag", Type: "string"})
+	cm.AddColumn(ProcessColumn{Name: "date", Mapping: "date", Type: "string"})
+	cm.AddColumn(ProcessColumn{Name: "n", Mapping: "n", Type: "int", Failure: "keep-null"})
+
+	filter, _ := NewFilter(`tag != "skip"`)
+	expand, _ := NewExpander(Unpivot{}, Split{Column: "tag"})
+	rejects, err := NewRejects("test-process", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(rejects.Path()))
+	defer rejects.Close()
+
+	jf := &JobFile{
+		addColumns: []string{"date"},
+		Mapping:    cm,
+		Filter:     filter,
+		Expand:     expand,
+		Rejects:    rejects,
+		Stats:      NewStats(),
+	}
+
+	rows := jf.process(2, Row{"id": "1", "tag": "a, skip, b"})
+	if len(rows) != 2 || rows[0].Get("tag") != "a" || rows[1].Get("tag") != "b" || rows[0].Get("date") != "" {
+		t.Errorf("Unexpected rows %v", rows)
+	}
+
+	rows = jf.process(3, Row{"id": "x", "tag": "a"})
+	if len(rows) != 0 {
+		t.Errorf("Expecting no rows, got %v", rows)
+	}
+
+	if jf.Stats.Accepted.GetCount() != 2 || jf.Stats.Filtered.GetCount() != 1 || jf.Stats.Rejected.GetCount() != 1 {
+		t.Errorf("Unexpected stats %d accepted, %d filtered, %d rejected", jf.Stats.Accepted.GetCount(), jf.Stats.Filtered.GetCount(), jf.Stats.Rejected.GetCount())
+	}
+
+	jf.process(4, Row{"id": "3", "tag": "c", "n": "x"})
+	if kept := jf.Stats.Kept.GetCounts(); kept["n (keep-null)"] != 1 {
+		t.Errorf("Expecting 1 kept field, got %v", kept)
+	}
+}
+
+func TestJobFileProcessNoUnpivotColumns(t *testing.T) {
+	cm := NewColumnMap()
+	cm.AddColumn(ProcessColumn{Name: "id", Mapping: "id", Type: "int"})
+	cm.AddColumn(ProcessColumn{Name: "month", Mapping: "month", Type: "string"})
+	cm.AddColumn(ProcessColumn{Name: "n", Mapping: "n", Type: "int"})
+
+	expand, _ := NewExpander(Unpivot{Columns: []string{"jan", "feb"}, Key: "month", Value: "n"}, Split{})
+	rejects, err := NewRejects("test-process-unpivot", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(rejects.Path()))
+
+	jf := &JobFile{
+		Mapping: cm,
+		Expand:  expand,
+		Rejects: rejects,
+		Stats:   NewStats(),
+	}
+
+	if rows := jf.process(2, Row{"id": "1"}); len(rows) != 0 {
+		t.Errorf("Expecting no rows, got %v", rows)
+	}
+	if jf.Stats.Rejected.GetCount() != 1 || rejects.Count() != 1 {
+		t.Errorf("Expecting the row to be rejected, got %d", jf.Stats.Rejected.GetCount())
+	}
+
+	rejects.Close()
+	b, _ := ioutil.ReadFile(rejects.Path())
+	if !strings.Contains(string(b), "2,unpivot,no unpivot columns,,1,") {
+		t.Errorf("Expecting the reason in the rejects, got %q", string(b))
+	}
+}
+
+func TestThresholdsCheck(t *testing.T) {
+	s := NewStats()
+	for i := 0; i < 10; i++ {
+		s.Processed.Count()
+	}
+	for i := 0; i < 8; i++ {
+		s.Accepted.Count()
+	}
+	s.Rejected.Count()
+	s.Rejected.Count()
+
+	testData := []struct {
+		n    string
+		t    Thresholds
+		fail bool
+	}{
+		{"disabled", Thresholds{}, false},
+		{"min rows ok", Thresholds{MinRows: 10}, false},
+		{"min rows", Thresholds{MinRows: 11}, true},
+		{"rejected rows ok", Thresholds{MaxRejectedRows: 2}, false},
+		{"rejected rows", Thresholds{MaxRejectedRows: 1}, true},
+		{"rejected percent ok", Thresholds{MaxRejectedPercent: 20}, false},
+		{"rejected percent", Thresholds{MaxRejectedPercent: 19.9}, true},
+	}
+
+	for _, d := range testData {
+		if err := d.t.Check(s); (err != nil) != d.fail {
+			t.Errorf("%s: expecting failure %v, got %v", d.n, d.fail, err)
+		}
+	}
+}
+
+func TestThresholdsCheckOutputRejects(t *testing.T) {
+	s := NewStats()
+	for i := 0; i < 10; i++ {
+		s.Processed.Count()
+		s.Accepted.Count()
+	}
+	// Every row rejected by the output, as Run counts them
+	s.Accepted.Sub(10)
+	s.Rejected.Add(10)
+
+	err := Thresholds{MaxRejectedPercent: 99}.Check(s)
+	if err == nil || !strings.Contains(err.Error(), "rejected 100.00%") {
+		t.Errorf("Expecting 100%% rejected, got %v", err)
+	}
+
+	s.Accepted.Sub(1)
+	if n := s.Accepted.GetCount(); n != 0 {
+		t.Errorf("Expecting the count to stop at 0, got %d", n)
+	}
+}
+
+func TestJobDoneFailed(t *testing.T) {
+	j := &Job{
+		Name:      "test",
+		StartTime: time.Now(),
+	}
+
+	n := &NotifyTest{c: 0}
+	jf := &JobFile{
+		Notify:  []notifications.Notifier{n},
+		Stats:   NewStats(),
+		Failure: errors.New("too many rejects"),
+	}
+
+	j.Done(jf)
+
+	if n.m.Status != notifications.StatusFailed || n.m.Error != "too many rejects" {
+		t.Errorf("Expecting FAILED status, got %v", n.m)
+	}
+}
+
+type captureOutput struct {
+	rows   []RowProcessed
+	closed bool
+}
+
+func (c *captureOutput) Open()                  {}
+func (c *captureOutput) Write(row RowProcessed) { c.rows = append(c.rows, row) }
+func (c *captureOutput) Close()                 { c.closed = true }
+
+func TestJobFileRunOrdered(t *testing.T) {
+	rows := 5000
+
+	f, err := ioutil.TempFile("", "metl-ordered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "id")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintln(f, i)
+	}
+	f.Close()
+
+	cm := NewColumnMap()
+	cm.AddColumn(ProcessColumn{Name: "id", Mapping: "id", Type: "int", Failure: "reject"})
+	// Filtered rows still need to pass through the sequencer
+	filter, _ := NewFilter(`id =~ "[02468]$"`)
+
+	rejects, err := NewRejects("test-ordered", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(rejects.Path()))
+
+	out := &captureOutput{}
+	jf := &JobFile{
+		workers:  8,
+		ordered:  true,
+		Filepath: f.Name(),
+		Parser: &CSVParser{
+			Options: map[string]interface{}{"header": true},
+		},
+		Mapping: cm,
+		Filter:  filter,
+		Rejects: rejects,
+		Output:  out,
+		Stats:   NewStats(),
+	}
+	jf.Run()
+
+	if len(out.rows) != rows/2 {
+		t.Fatalf("Expecting %d rows, got %d", rows/2, len(out.rows))
+	}
+	for i, row := range out.rows {
+		if row.Get("id") != int64(i*2) {
+			t.Fatalf("Expecting %d, got %v", i*2, row.Get("id"))
+		}
+	}
+	if !out.closed {
+		t.Error("Expecting output to be closed")
+	}
+}
+
+// failingOutput fails to write every row.
+type failingOutput struct {
+	captureOutput
+	rolledBack bool
+}
+
+func (f *failingOutput) Failed() uint { return uint(len(f.rows)) }
+func (f *failingOutput) Rollback()    { f.rolledBack = true }
+
+func TestJobFileRunFailOnOutput(t *testing.T) {
+	f, err := ioutil.TempFile("", "metl-outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "id\n1\n2\n")
+	f.Close()
+
+	rejects, err := NewRejects("test-outputs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(rejects.Path()))
+
+	cm := NewColumnMap()
+	cm.AddColumn(ProcessColumn{Name: "id", Mapping: "id", Type: "int"})
+
+	for _, failOnOutput := range []bool{false, true} {
+		failing, capture := &failingOutput{}, &captureOutput{}
+		jf := &JobFile{
+			workers:  1,
+			Filepath: f.Name(),
+			Parser: &CSVParser{
+				Options: map[string]interface{}{"header": true},
+			},
+			Mapping: cm,
+			Rejects: rejects,
+			Output: &MultiOutput{
+				Names:   []string{"db", "archive"},
+				Outputs: []Outputter{failing, capture},
+			},
+			Stats:        NewStats(),
+			failOnOutput: failOnOutput,
+		}
+		jf.Run()
+
+		if len(capture.rows) != 2 || !capture.closed {
+			t.Errorf("Expecting 2 rows written to every output, got %d", len(capture.rows))
+		}
+		if failOnOutput {
+			if jf.Failure == nil || jf.Failure.Error() != "failed to write to db (2 rows)" || !failing.rolledBack {
+				t.Errorf("Expecting the failed output to fail and roll back the run, got %v", jf.Failure)
+			}
+			if c := jf.Stats.FailedOutputs.GetCounts(); c["db"] != 2 || jf.Stats.Failed.GetCount() != 2 {
+				t.Errorf("Expecting 2 rows failed for db after rolling back, got %v", c)
+			}
+			continue
+		}
+		if jf.Failure != nil || failing.rolledBack || !failing.closed {
+			t.Errorf("Expecting the run to succeed, got %v", jf.Failure)
+		}
+		if c := jf.Stats.FailedOutputs.GetCounts(); c["db"] != 2 || jf.Stats.Failed.GetCount() != 2 {
+			t.Errorf("Expecting 2 rows failed for db, got %v", c)
+		}
+	}
+}
+
+// rollbackOutput writes every row and can roll them back.
+type rollbackOutput struct {
+	captureOutput
+	rolledBack bool
+}
+
+func (r *rollbackOutput) Rollback() { r.rolledBack = true }
+
+// finishingOutput holds rows back until Finish, which fails to write them.
+type finishingOutput struct {
+	rollbackOutput
+	finished bool
+}
+
+func (f *finishingOutput) Finish() { f.finished = true }
+func (f *finishingOutput) Failed() uint {
+	if !f.finished {
+		return 0
+	}
+	return uint(len(f.rows))
+}
+
+func TestJobFileRunFailOnFinish(t *testing.T) {
+	f, err := ioutil.TempFile("", "metl-finish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "id\n1\n2\n")
+	f.Close()
+
+	rejects, err := NewRejects("test-finish", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(rejects.Path()))
+
+	cm := NewColumnMap()
+	cm.AddColumn(ProcessColumn{Name: "id", Mapping: "id", Type: "int"})
+
+	// The archive is written first, it must not be committed when the db fails on Finish
+	archive, db := &rollbackOutput{}, &finishingOutput{}
+	jf := &JobFile{
+		workers:  1,
+		Filepath: f.Name(),
+		Parser: &CSVParser{
+			Options: map[string]interface{}{"header": true},
+		},
+		Mapping: cm,
+		Rejects: rejects,
+		Output: &MultiOutput{
+			Names:   []string{"archive", "db"},
+			Outputs: []Outputter{archive, db},
+		},
+		Stats:        NewStats(),
+		failOnOutput: true,
+	}
+	jf.Run()
+
+	if jf.Failure == nil || jf.Failure.Error() != "failed to write to db (2 rows)" {
+		t.Errorf("Expecting the run to fail, got %v", jf.Failure)
+	}
+	if !archive.rolledBack || archive.closed || !db.rolledBack || db.closed {
+		t.Errorf("Expecting every output to be rolled back")
+	}
+	if c := jf.Stats.FailedOutputs.GetCounts(); c["db"] != 2 || jf.Stats.Failed.GetCount() != 2 {
+		t.Errorf("Expecting 2 rows failed for db, got %v", c)
+	}
+}
+
+// rejectingOutput rejects every row it writes.
+type rejectingOutput struct {
+	captureOutput
+	rolledBack bool
+}
+
+func (r *rejectingOutput) Rejected() uint { return uint(len(r.rows)) }
+func (r *rejectingOutput) Rollback()      { r.rolledBack = true }
+
+func TestJobFileRunOutputRejects(t *testing.T) {
+	f, err := ioutil.TempFile("", "metl-output-rejects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "id\n1\n2\n")
+	f.Close()
+
+	rejects, err := NewRejects("test-output-rejects", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(rejects.Path()))
+
+	cm := NewColumnMap()
+	cm.AddColumn(ProcessColumn{Name: "id", Mapping: "id", Type: "int"})
+
+	out := &rejectingOutput{}
+	jf := &JobFile{
+		workers:  1,
+		Filepath: f.Name(),
+		Parser: &CSVParser{
+			Options: map[string]interface{}{"header": true},
+		},
+		Mapping:    cm,
+		Rejects:    rejects,
+		Output:     &MultiOutput{Names: []string{"index"}, Outputs: []Outputter{out}},
+		Stats:      NewStats(),
+		Thresholds: Thresholds{MaxRejectedRows: 1},
+	}
+	jf.Run()
+
+	if jf.Stats.Rejected.GetCount() != 2 || jf.Failure == nil || !out.rolledBack {
+		t.Errorf("Expecting 2 rejected rows to fail the run, got %d and %v", jf.Stats.Rejected.GetCount(), jf.Failure)
+	}
+}
+
+func TestJobRunDedupeFailure(t *testing.T) {
+	rejects, err := NewRejects("test-dedupe-failure", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(rejects.Path()))
+	script, err := NewScript("../../test_data/script.lua", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dedupe, _ := NewDeduper([]string{"missing"}, "first", 0, "")
+
+	jf := &JobFile{
+		workers:  1,
+		Filepath: duplicatesLocation,
+		Parser: &CSVParser{
+			Options: map[string]interface{}{"header": true},
+		},
+		Dedupe:  dedupe,
+		Script:  script,
+		Rejects: rejects,
+		Stats:   NewStats(),
+	}
+	jf.Run()
+
+	if jf.Failure == nil {
+		t.Error("Expecting the run to fail, got nil")
+	}
+	// The reject file is saved and the script closed, as after a normal run
+	if _, err := os.Stat(rejects.Path()); err != nil {
+		t.Errorf("Expecting the reject file to be saved, got %v", err)
+	}
+	select {
+	case <-script.states:
+		t.Error("Expecting the script to be closed")
+	default:
+	}
+}
+
+func TestJobOutputConfigs(t *testing.T) {
+	j := &Job{}
+	if c, err := j.OutputConfigs(); err != nil || len(c) != 1 || c[0].Name != "" {
+		t.Errorf("Expecting the legacy output only, got %v", c)
+	}
+
+	j.Job.Outputting = OutputConfig{Engine: "mysql"}
+	j.Job.Outputs = []OutputConfig{
+		{Engine: "csv"},
+		{Engine: "mysql"},
+		{Name: "search", Engine: "elasticsearch"},
+	}
+	configs, err := j.OutputConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, c := range configs {
+		names = append(names, c.Name)
+	}
+	if fmt.Sprint(names) != "[mysql csv mysql-2 search]" {
+		t.Errorf("Expecting [mysql csv mysql-2 search], got %v", names)
+	}
+
+	j.Job.Outputting = OutputConfig{}
+	if c, err := j.OutputConfigs(); err != nil || len(c) != 3 || c[0].Name != "csv" {
+		t.Errorf("Expecting the outputs only, got %v %v", c, err)
+	}
+
+	// A given name taken by an added one, or given twice
+	for _, outputs := range [][]OutputConfig{
+		{{Name: "mysql-2", Engine: "csv"}, {Engine: "mysql"}, {Engine: "mysql"}},
+		{{Name: "search", Engine: "elasticsearch"}, {Name: "search", Engine: "http"}},
+	} {
+		j.Job.Outputs = outputs
+		if _, err := j.OutputConfigs(); err == nil {
+			t.Errorf("Expecting duplicate names in %v to fail", outputs)
+		}
+	}
+}
+
+func TestJobOutputColumns(t *testing.T) {
+	j := &Job{}
+	j.Job.Processing.AddColumns = []string{"date"}
+	j.Job.Processing.Columns = []ProcessColumn{
+		{Name: "1", Discard: true},
+		{Name: "2", Mapping: "mengde"},
+		{Name: "3", Mapping: "valuta"},
+		{Name: "4", Mapping: "mengde"},
+		{Name: "date", Mapping: "dato"},
+	}
+
+	expected := []string{"mengde", "valuta", "dato"}
+	if c := j.OutputColumns(); fmt.Sprint(c) != fmt.Sprint(expected) {
+		t.Errorf("Expecting %v, got %v", expected, c)
+	}
+
+	j.Job.Processing.Aggregate.GroupBy = []string{"valuta"}
+	j.Job.Processing.Aggregate.Columns = []AggregateColumn{{"total", "sum", "mengde"}}
+	if c := j.OutputColumns(); fmt.Sprint(c) != "[valuta total]" {
+		t.Errorf("Expecting [valuta total], got %v", c)
+	}
+
+	j.Job.Processing.Script = "test.lua"
+	if c := j.OutputColumns(); c != nil {
+		t.Errorf("Expecting nil, got %v", c)
+	}
+}
+
+func TestJobOutputColumnTypes(t *testing.T) {
+	j := &Job{}
+	j.Job.Processing.Columns = []ProcessColumn{
+		{Name: "1", Mapping: "skipped", Type: "int", Discard: true},
+		{Name: "2", Mapping: "mengde", Type: "int"},
+		{Name: "3", Mapping: "valuta"},
+		{Name: "4", Mapping: "dato", Type: "date"},
+		{Name: "5", Mapping: "kurs", Type: "decimal"},
+	}
+	j.Job.Processing.Aggregate.Columns = []AggregateColumn{
+		{"total", "sum", "mengde"},
+		{"kurser", "sum", "kurs"},
+		{"rows", "count", ""},
+		{"last", "max", "dato"},
+	}
+
+	expected := map[string]string{
+		"mengde": "int",
+		"valuta": "string",
+		"dato":   "date",
+		"kurs":   "decimal",
+		"total":  "float",
+		"kurser": "decimal",
+		"rows":   "int",
+		"last":   "date",
+	}
+	types := j.OutputColumnTypes()
+	if len(types) != len(expected) {
+		t.Errorf("Expecting %v, got %v", expected, types)
+	}
+	for k, v := range expected {
+		if types[k] != v {
+			t.Errorf("Expecting %s for %s, got %s", v, k, types[k])
+		}
+	}
 }
@@ -0,0 +1,137 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// LookupSource configures where a lookup table is loaded from:
+//
+//	csv    - File, with Key and Value naming the header columns to use
+//	sql    - Driver, Dsn and a Query selecting exactly two columns, key and value
+//	inline - Values, a TOML table in the job file
+type LookupSource struct {
+	Source string
+	File   string
+	Key    string
+	Value  string
+	Driver string
+	Dsn    string
+	Query  string
+	Values map[string]string
+}
+
+// Lookup maps keys to values.  Lookups are loaded once per run and only read while
+// processing, so they are shared between workers without locking.
+type Lookup map[string]string
+
+// LoadLookup loads a lookup table, relative CSV files are resolved from dir.
+func LoadLookup(name string, src LookupSource, dir string) (Lookup, error) {
+	logFields := log.Fields{
+		"lookup": name,
+		"source": src.Source,
+	}
+
+	var l Lookup
+	var err error
+	switch src.Source {
+	case "csv":
+		file := src.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		l, err = loadCSVLookup(file, src.Key, src.Value)
+	case "sql":
+		l, err = loadSQLLookup(src.Driver, src.Dsn, src.Query)
+	case "inline":
+		l = Lookup(src.Values)
+		if l == nil {
+			l = make(Lookup)
+		}
+	default:
+		err = fmt.Errorf("unknown source %q", src.Source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %s", name, err)
+	}
+
+	log.WithFields(logFields).Infof("Loaded %d lookup values", len(l))
+	return l, nil
+}
+
+func loadCSVLookup(file, key, value string) (Lookup, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	k, v := -1, -1
+	for i, h := range header {
+		switch h {
+		case key:
+			k = i
+		case value:
+			v = i
+		}
+	}
+	if k < 0 || v < 0 {
+		return nil, fmt.Errorf("columns %q and %q not found in %s", key, value, file)
+	}
+
+	l := make(Lookup)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) > k && len(record) > v {
+			l[record[k]] = record[v]
+		}
+	}
+	return l, nil
+}
+
+func loadSQLLookup(driver, dsn, query string) (Lookup, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	l := make(Lookup)
+	for rows.Next() {
+		var k, v sql.NullString
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		l[k.String] = v.String
+	}
+	return l, rows.Err()
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"testing"
+)
+
+func TestLoadLookupCSV(t *testing.T) {
+	l, err := LoadLookup("currencies", LookupSource{
+		Source: "csv",
+		File:   "lookup.csv",
+		Key:    "code",
+		Value:  "id",
+	}, "../../test_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(l) != 2 || l["NOK"] != "1" || l["SEK"] != "2" {
+		t.Errorf("Unexpected lookup %v", l)
+	}
+}
+
+func TestLoadLookupCSVMissingColumn(t *testing.T) {
+	_, err := LoadLookup("currencies", LookupSource{
+		Source: "csv",
+		File:   "lookup.csv",
+		Key:    "code",
+		Value:  "missing",
+	}, "../../test_data")
+	if err == nil {
+		t.Error("Expecting error, got nil")
+	}
+}
+
+func TestLoadLookupInline(t *testing.T) {
+	l, err := LoadLookup("status", LookupSource{
+		Source: "inline",
+		Values: map[string]string{"A": "active"},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l["A"] != "active" {
+		t.Errorf("Expecting active, got %v", l["A"])
+	}
+}
+
+func TestLoadLookupUnknownSource(t *testing.T) {
+	if _, err := LoadLookup("x", LookupSource{Source: "ldap"}, ""); err == nil {
+		t.Error("Expecting error, got nil")
+	}
+}
+
+func TestProcessLookup(t *testing.T) {
+	cm := NewColumnMap()
+	cm.AddLookup("status", Lookup{"A": "active"})
+	cm.AddColumn(ProcessColumn{Name: "reject", Mapping: "REJECT", Type: "string", Lookup: "status"})
+	cm.AddColumn(ProcessColumn{Name: "keep", Mapping: "KEEP", Type: "string", Lookup: "status", LookupMiss: "keep"})
+	cm.AddColumn(ProcessColumn{Name: "default", Mapping: "DEFAULT", Type: "string", Lookup: "status", LookupMiss: "default", LookupDefault: "unknown"})
+
+	testData := []struct {
+		column, value, mapping, e string
+	}{
+		{"reject", "A", "REJECT", "active"},
+		{"keep", "X", "KEEP", "X"},
+		{"default", "X", "DEFAULT", "unknown"},
+		{"default", "A", "DEFAULT", "active"},
+	}
+
+	for _, d := range testData {
+		prow, err := Row{d.column: d.value}.Process(&cm)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", d.column, err)
+			continue
+		}
+		if prow.Get(d.mapping) != d.e {
+			t.Errorf("%s: expecting %s, got %v", d.column, d.e, prow.Get(d.mapping))
+		}
+	}
+
+	if _, err := (Row{"reject": "X"}).Process(&cm); err == nil {
+		t.Error("Expecting lookup miss to reject row")
+	}
+}
@@ -6,21 +6,89 @@ package job
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	"io"
 	"strings"
 )
 
+var (
+	// Rows per multi-row INSERT unless batchSize is set
+	mysqlBatchSize = 1000
+	// Placeholders allowed in a prepared statement, which limits the rows per INSERT
+	mysqlPlaceholders = 65535
+)
+
+// Mysql inserts rows using multi-row INSERTs of batchSize rows, or streams them with
+// LOAD DATA LOCAL INFILE when loadData is set.  With commit "all" (default) everything is
+// loaded in a single transaction which is committed on Close, with commit "batch" each
+// batch is committed as soon as it is written.  A batch which fails is inserted again row
+// by row, so only the rows which fail are lost, and counted.  All rows of a transaction
+// which fails to commit are counted as failed.  Errors which make the server roll back the
+// whole transaction, e.g. a deadlock, are not retried: every row written in it and every
+// later row fails, and the run fails (see Aborter).
+//
+// The mode decides what happens to existing rows:
+//
+//	insert       - plain INSERT (default)
+//	insertIgnore - INSERT IGNORE, rows with existing keys are skipped
+//	replace      - REPLACE, rows with existing keys are replaced
+//	upsert       - INSERT ... ON DUPLICATE KEY UPDATE of updateColumns (default all
+//	               columns except keyColumns)
+//	update       - UPDATE of the other columns WHERE keyColumns match, one row at a time;
+//	               rows matching no row in the table fail
+//
+// The cleanup decides what happens to the table before loading:
+//
+//	truncate - all rows are deleted
+//	delete   - the rows matching cleanupWhere are deleted, e.g. "date = CURDATE()"
+//	staging  - rows are loaded into an empty copy of the table, <table>_tmp, which
+//	           replaces the table with an atomic RENAME TABLE once the run has succeeded
+//
+// Cleanup is done in the load's transaction, so with commit "all" nothing changes until the
+// run has passed its thresholds.
+//
+//	[job.outputting.options]
+//	dsn = "user:pass@tcp(localhost:3306)/data"
+//	table = "currencies"
+//	batchSize = 1000
+//	commit = "all"
+//	loadData = false
+//	mode = "upsert"
+//	keyColumns = ["date", "valuta"]
 type Mysql struct {
 	Options map[string]interface{}
 
-	db   *sql.DB
-	stmt *sql.Stmt
+	db *sql.DB
+	tx *sql.Tx
+
+	batchSize     int
+	commitBatch   bool
+	loadData      bool
+	mode          string
+	keyColumns    []string
+	updateColumns []string
+	cleanup       string
+	cleanupWhere  string
 
 	prepared bool
+	stmt     *sql.Stmt
+	columns  []string
+	batch    [][]interface{}
+	// Rows written in the open transaction
+	pending uint
+	rows    uint
+	failed  uint
+	// A commit failed, so the staging table is incomplete
+	uncommitted bool
+	finished    bool
+	// Set when the server rolled back the transaction, see abort
+	aborted error
 
-	columns []string
+	load    *mysqlLoad
+	rejects *Rejects
 }
 
 func (m *Mysql) Write(row RowProcessed) {
@@ -28,30 +96,74 @@ func (m *Mysql) Write(row RowProcessed) {
 	if !m.prepared {
 		m.prepareQuery(row)
 	}
+	m.rows++
+	if m.aborted != nil {
+		m.failed++
+		return
+	}
 
-	// Match data up in the order of our columns
+	// Match data up in the order of our columns, null (nil) values are inserted as NULL
 	data := make([]interface{}, len(m.columns))
 	for i, v := range m.columns {
-		data[i] = row[v]
+		data[i] = row.Get(v)
 	}
 
-	_, err := m.stmt.Exec(data...)
-	if err != nil {
-		log.Warn(err)
+	if m.load != nil {
+		m.load.write(data)
+		return
+	}
+
+	m.batch = append(m.batch, data)
+	if len(m.batch) >= m.batchSize {
+		m.flush()
 	}
 }
 
-func (m *Mysql) prepareQuery(row RowProcessed) {
-	m.columns = make([]string, 0)
-	vals := m.columns
+// SetColumns sets the columns written, in order.  Without them the columns of the first
+// row are used.
+func (m *Mysql) SetColumns(columns []string) {
+	m.columns = columns
+}
+
+// SetRejects sets where rows which fail to be written are saved.
+func (m *Mysql) SetRejects(rejects *Rejects) {
+	m.rejects = rejects
+}
 
-	for k := range row {
-		m.columns = append(m.columns, k)
-		vals = append(vals, "?")
+// reject counts a row which failed to be written and saves it to the reject file, if set.
+func (m *Mysql) reject(data []interface{}, err error) {
+	m.failed++
+	if m.rejects == nil {
+		return
+	}
+	raw := make(Row, len(m.columns))
+	for i, c := range m.columns {
+		raw[c] = formatValue(data[i])
 	}
+	m.rejects.Write(0, raw, fmt.Errorf("output: %s", err))
+}
+
+func (m *Mysql) prepareQuery(row RowProcessed) {
+	if m.columns == nil {
+		m.columns = make([]string, 0)
+		for _, k := range row.Columns {
+			m.columns = append(m.columns, k)
+		}
+		if err := m.checkUpdates(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	m.batchSize = mysqlBatchLimit(m.batchSize, len(m.columns))
 
 	var err error
-	m.stmt, err = m.db.Prepare(fmt.Sprintf("insert into %s (%s) values (%s)", m.Options["table"], strings.Join(m.columns, ","), strings.Join(vals, ",")))
+	switch {
+	case m.loadData:
+		m.load = newMysqlLoad(m.table(), m.mode, m.columns, m.exec)
+	case m.mode == "update":
+		m.stmt, err = m.db.Prepare(m.updateQuery())
+	default:
+		m.stmt, err = m.db.Prepare(m.insertQuery(m.batchSize))
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -59,6 +171,305 @@ func (m *Mysql) prepareQuery(row RowProcessed) {
 	m.prepared = true
 }
 
+// mysqlBatchLimit limits the rows per INSERT to what the placeholders allow.
+func mysqlBatchLimit(batchSize int, columns int) int {
+	if columns > 0 && batchSize > mysqlPlaceholders/columns {
+		return mysqlPlaceholders / columns
+	}
+	return batchSize
+}
+
+// table is where rows are written, the staging table when staging.
+func (m *Mysql) table() string {
+	if m.cleanup == "staging" {
+		return m.target() + "_tmp"
+	}
+	return m.target()
+}
+
+func (m *Mysql) target() string {
+	return m.Options["table"].(string)
+}
+
+// insertQuery creates a multi-row INSERT for rows rows, according to the mode.
+func (m *Mysql) insertQuery(rows int) string {
+	verb := "insert into"
+	switch m.mode {
+	case "insertIgnore":
+		verb = "insert ignore into"
+	case "replace":
+		verb = "replace into"
+	}
+
+	vals := "(" + strings.TrimSuffix(strings.Repeat("?,", len(m.columns)), ",") + ")"
+	query := fmt.Sprintf("%s %s (%s) values %s", verb, m.table(), strings.Join(m.columns, ","), strings.TrimSuffix(strings.Repeat(vals+",", rows), ","))
+
+	if m.mode == "upsert" {
+		updates := make([]string, 0, len(m.columns))
+		for _, c := range m.upsertColumns() {
+			updates = append(updates, fmt.Sprintf("%s=values(%s)", c, c))
+		}
+		query += " on duplicate key update " + strings.Join(updates, ",")
+	}
+	return query
+}
+
+// upsertColumns are the updateColumns, or all columns which are not keys.
+func (m *Mysql) upsertColumns() []string {
+	if len(m.updateColumns) > 0 {
+		return m.updateColumns
+	}
+	return m.nonKeyColumns()
+}
+
+// checkUpdates fails the modes which update rows when every column written is a key, as
+// there is nothing to update.  Columns taken from the first row are checked once known.
+func (m *Mysql) checkUpdates() error {
+	if m.columns == nil {
+		return nil
+	}
+	if (m.mode == "update" && len(m.nonKeyColumns()) == 0) || (m.mode == "upsert" && len(m.upsertColumns()) == 0) {
+		return fmt.Errorf("MySQL mode %s requires a column which is not in keyColumns", m.mode)
+	}
+	return nil
+}
+
+func (m *Mysql) nonKeyColumns() []string {
+	columns := make([]string, 0, len(m.columns))
+	for _, c := range m.columns {
+		if !inStrings(m.keyColumns, c) {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+// updateQuery creates an UPDATE of a single row by its key columns.  Values are expected in
+// the order of the columns, see updateArgs.
+func (m *Mysql) updateQuery() string {
+	sets := make([]string, 0, len(m.columns))
+	for _, c := range m.nonKeyColumns() {
+		sets = append(sets, c+"=?")
+	}
+	where := make([]string, 0, len(m.keyColumns))
+	for _, c := range m.keyColumns {
+		where = append(where, c+"=?")
+	}
+	return fmt.Sprintf("update %s set %s where %s", m.table(), strings.Join(sets, ","), strings.Join(where, " and "))
+}
+
+// updateArgs orders a row's values for updateQuery: the other columns, then the keys.
+func (m *Mysql) updateArgs(data []interface{}) []interface{} {
+	args := make([]interface{}, 0, len(data))
+	for i, c := range m.columns {
+		if !inStrings(m.keyColumns, c) {
+			args = append(args, data[i])
+		}
+	}
+	for _, k := range m.keyColumns {
+		for i, c := range m.columns {
+			if c == k {
+				args = append(args, data[i])
+			}
+		}
+	}
+	return args
+}
+
+func inStrings(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// exec runs a statement in the current transaction, starting one if needed.
+func (m *Mysql) exec(query string, args ...interface{}) (sql.Result, error) {
+	if m.tx == nil {
+		var err error
+		if m.tx, err = m.db.Begin(); err != nil {
+			return nil, err
+		}
+	}
+	return m.tx.Exec(query, args...)
+}
+
+// flush writes the batched rows in one statement.
+func (m *Mysql) flush() {
+	if len(m.batch) == 0 {
+		return
+	}
+
+	if m.mode == "update" {
+		m.flushUpdates()
+		return
+	}
+
+	args := make([]interface{}, 0, len(m.batch)*len(m.columns))
+	for _, data := range m.batch {
+		args = append(args, data...)
+	}
+
+	var err error
+	if len(m.batch) == m.batchSize {
+		if m.tx == nil {
+			m.tx, err = m.db.Begin()
+		}
+		if err == nil {
+			_, err = m.tx.Stmt(m.stmt).Exec(args...)
+		}
+	} else {
+		_, err = m.exec(m.insertQuery(len(m.batch)), args...)
+	}
+	if err != nil && mysqlAborts(err) {
+		m.abort(err)
+	} else if err != nil {
+		log.WithFields(log.Fields{
+			"rows": len(m.batch),
+		}).Warn("Failed to insert batch, inserting its rows one by one: ", err)
+		m.insertRows()
+	} else {
+		m.pending += uint(len(m.batch))
+	}
+	m.batch = m.batch[:0]
+
+	if m.commitBatch {
+		m.commit()
+	}
+}
+
+// insertRows inserts the batched rows one at a time.
+func (m *Mysql) insertRows() {
+	query := m.insertQuery(1)
+	for i, data := range m.batch {
+		if _, err := m.exec(query, data...); err != nil {
+			if mysqlAborts(err) {
+				m.batch = m.batch[i:]
+				m.abort(err)
+				return
+			}
+			m.reject(data, err)
+			log.Warn("Failed to insert row: ", err)
+			continue
+		}
+		m.pending++
+	}
+}
+
+// flushUpdates updates the batched rows one by one.  A row whose key matches no row in the
+// table has failed, as it is not written anywhere.
+func (m *Mysql) flushUpdates() {
+	var err error
+	if m.tx == nil {
+		if m.tx, err = m.db.Begin(); err != nil {
+			for _, data := range m.batch {
+				m.reject(data, err)
+			}
+			log.Warn("Failed to update batch: ", err)
+		}
+	}
+
+	if err == nil {
+		stmt := m.tx.Stmt(m.stmt)
+		for i, data := range m.batch {
+			res, err := stmt.Exec(m.updateArgs(data)...)
+			if err != nil && mysqlAborts(err) {
+				m.batch = m.batch[i:]
+				m.abort(err)
+				return
+			}
+			if err == nil {
+				err = updated(res)
+			}
+			if err != nil {
+				m.reject(data, err)
+				log.Warn("Failed to update row: ", err)
+				continue
+			}
+			m.pending++
+		}
+	}
+	m.batch = m.batch[:0]
+
+	if m.commitBatch {
+		m.commit()
+	}
+}
+
+// mysqlAborts reports whether an error rolled back the whole transaction on the server:
+// a deadlock, a lock wait timeout (which does so with innodb_rollback_on_timeout, and
+// can not be told apart) or a lost connection.
+func mysqlAborts(err error) bool {
+	if e, ok := err.(*mysql.MySQLError); ok {
+		return e.Number == 1213 || e.Number == 1205
+	}
+	return err == driver.ErrBadConn
+}
+
+// abort fails the rows of a transaction the server rolled back, the rows left in the batch
+// and, as Write counts them only, every later row.
+func (m *Mysql) abort(err error) {
+	lost := m.pending + uint(len(m.batch))
+	log.Errorf("Transaction aborted, failed to write %d rows: %s", lost, err)
+	m.failed += lost
+	m.pending = 0
+	m.batch = m.batch[:0]
+	m.aborted = err
+	// Nothing written after this is visible in the staging table either
+	m.uncommitted = true
+	if m.tx != nil {
+		m.tx.Rollback()
+		m.tx = nil
+	}
+}
+
+// Aborted returns the error which rolled back a transaction, rows reported as written may
+// have been lost with it.
+func (m *Mysql) Aborted() error {
+	if m.aborted != nil {
+		return fmt.Errorf("MySQL transaction aborted: %s", m.aborted)
+	}
+	return nil
+}
+
+// updated checks that an UPDATE matched a row.  The connection reports matched rather than
+// changed rows (see mysqlFoundRows), so a row updated with the values it had counts.
+func updated(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no row with the key to update")
+	}
+	return nil
+}
+
+// mysqlFoundRows makes a DSN's connections report the rows an UPDATE matched as affected,
+// instead of the rows it changed.
+func mysqlFoundRows(dsn string) string {
+	if strings.Contains(dsn, "?") {
+		return dsn + "&clientFoundRows=true"
+	}
+	return dsn + "?clientFoundRows=true"
+}
+
+func (m *Mysql) commit() {
+	if m.tx == nil {
+		return
+	}
+	// The rows written in a transaction which fails to commit are lost
+	if err := m.tx.Commit(); err != nil {
+		m.failed += m.pending
+		m.uncommitted = true
+		log.Errorf("Failed to commit %d rows: %s", m.pending, err)
+	}
+	m.tx = nil
+	m.pending = 0
+}
+
 func (m *Mysql) Open() {
 	parts := strings.FieldsFunc(m.Options["dsn"].(string), func(c rune) bool {
 		return c == '/' || c == '@' || c == ':'
@@ -70,17 +481,384 @@ func (m *Mysql) Open() {
 		"database": parts[3],
 	}).Debug("Connecting to MySQL")
 
+	m.batchSize = mysqlBatchSize
+	if size, ok := m.Options["batchSize"].(int64); ok && size > 0 {
+		m.batchSize = int(size)
+	}
+	switch m.Options["commit"] {
+	case nil, "all":
+	case "batch":
+		m.commitBatch = true
+	default:
+		log.Fatalf("Unknown MySQL commit mode %s", m.Options["commit"])
+	}
+	m.loadData, _ = m.Options["loadData"].(bool)
+	m.keyColumns = stringsOption(m.Options["keyColumns"])
+	m.updateColumns = stringsOption(m.Options["updateColumns"])
+
+	m.mode, _ = m.Options["mode"].(string)
+	switch m.mode {
+	case "":
+		m.mode = "insert"
+	case "insert", "insertIgnore", "replace":
+	case "upsert", "update":
+		if m.loadData {
+			log.Fatalf("MySQL mode %s can not be used with loadData", m.mode)
+		}
+		if m.mode == "update" && len(m.keyColumns) == 0 {
+			log.Fatal("MySQL mode update requires keyColumns")
+		}
+	default:
+		log.Fatalf("Unknown MySQL mode %s", m.mode)
+	}
+
+	m.cleanup, _ = m.Options["cleanup"].(string)
+	m.cleanupWhere, _ = m.Options["cleanupWhere"].(string)
+	switch m.cleanup {
+	case "":
+	case "truncate", "delete":
+		if m.cleanup == "delete" && m.cleanupWhere == "" {
+			log.Fatal("MySQL cleanup delete requires cleanupWhere")
+		}
+		// The old rows would be gone with the first batch, whether the run succeeds or not
+		if m.commitBatch {
+			log.Fatalf("MySQL cleanup %s can not be used with commit batch, use staging", m.cleanup)
+		}
+	case "staging":
+		if m.mode == "update" {
+			log.Fatal("MySQL mode update can not be used with staging")
+		}
+	default:
+		log.Fatalf("Unknown MySQL cleanup %s", m.cleanup)
+	}
+
+	if err := m.checkUpdates(); err != nil {
+		log.Fatal(err)
+	}
+
+	dsn := m.Options["dsn"].(string)
+	if m.mode == "update" {
+		dsn = mysqlFoundRows(dsn)
+	}
+
 	var err error
-	m.db, err = sql.Open("mysql", m.Options["dsn"].(string))
+	m.db, err = sql.Open("mysql", dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Info("Connected to MySQL")
+
+	if err := m.validateColumns(); err != nil {
+		log.Fatal(err)
+	}
+
+	// DDL is not transactional, the staging table is created before the transaction
+	if m.cleanup == "staging" {
+		for _, query := range m.stagingQueries() {
+			if _, err := m.db.Exec(query); err != nil {
+				log.Fatal("Unable to create staging table: ", err)
+			}
+		}
+		log.Infof("Loading into staging table %s", m.table())
+	}
+
+	// Rows are only committed once the job has finished successfully, unless committing
+	// batch by batch
+	m.tx, err = m.db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if query := m.cleanupQuery(); query != "" {
+		if _, err := m.tx.Exec(query); err != nil {
+			log.Fatal("Unable to clean up table: ", err)
+		}
+		log.Infof("Cleaned up %s (%s)", m.table(), m.cleanup)
+	}
+}
+
+// validateColumns checks that the table has all the columns written, so a misconfigured
+// job fails before any row is written.
+func (m *Mysql) validateColumns() error {
+	rows, err := m.db.Query("select column_name from information_schema.columns where table_schema = database() and table_name = ?", m.target())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing := make([]string, 0)
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return err
+		}
+		existing = append(existing, c)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return fmt.Errorf("MySQL table %s does not exist", m.target())
+	}
+
+	if missing := missingColumns(existing, true, m.columns, m.keyColumns, m.updateColumns); len(missing) > 0 {
+		return fmt.Errorf("MySQL table %s has no column %s", m.target(), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// missingColumns returns the columns which do not exist.  Names are compared case
+// insensitively when fold is set, as MySQL column names are.
+func missingColumns(existing []string, fold bool, columns ...[]string) []string {
+	name := func(c string) string {
+		if fold {
+			return strings.ToLower(c)
+		}
+		return c
+	}
+
+	exists := make(map[string]bool)
+	for _, c := range existing {
+		exists[name(c)] = true
+	}
+
+	missing := make([]string, 0)
+	for _, list := range columns {
+		for _, c := range list {
+			if !exists[name(c)] && !inStrings(missing, c) {
+				missing = append(missing, c)
+			}
+		}
+	}
+	return missing
+}
+
+func (m *Mysql) stagingQueries() []string {
+	return []string{
+		fmt.Sprintf("drop table if exists %s", m.table()),
+		fmt.Sprintf("create table %s like %s", m.table(), m.target()),
+	}
+}
+
+// cleanupQuery deletes rows before loading.  Truncating is done with a DELETE, as TRUNCATE
+// TABLE can not be rolled back.
+func (m *Mysql) cleanupQuery() string {
+	switch m.cleanup {
+	case "truncate":
+		return fmt.Sprintf("delete from %s", m.table())
+	case "delete":
+		return fmt.Sprintf("delete from %s where %s", m.table(), m.cleanupWhere)
+	}
+	return ""
+}
+
+func (m *Mysql) swap() error {
+	for _, query := range m.swapQueries() {
+		if _, err := m.db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swapQueries replaces the table with the staging table.  Renaming both tables in one
+// statement is atomic, so readers see either the old or the new rows.  An old table left
+// by a run which crashed while swapping is dropped first.
+func (m *Mysql) swapQueries() []string {
+	return []string{
+		fmt.Sprintf("drop table if exists %s_old", m.target()),
+		fmt.Sprintf("rename table %s to %s_old, %s to %s", m.target(), m.target(), m.table(), m.target()),
+		fmt.Sprintf("drop table %s_old", m.target()),
+	}
+}
+
+// finish writes the rows which are left.
+func (m *Mysql) finish() {
+	if m.load != nil {
+		if err := m.load.close(); err != nil {
+			m.failed += m.load.rows
+			log.Warn("Failed to load data: ", err)
+			return
+		}
+		// LOAD DATA LOCAL skips rows with existing keys without an error, they fail as a
+		// plain INSERT would.  Replaced rows count twice, so only inserts are checked.
+		rows := m.load.rows
+		if m.mode == "insert" && m.load.affected < rows {
+			skipped := rows - m.load.affected
+			log.Warnf("Failed to load %d rows with existing keys", skipped)
+			m.failed += skipped
+			rows -= skipped
+		}
+		m.pending += rows
+		return
+	}
+	m.flush()
+}
+
+// Finish writes the rows which are left, they are committed on Close.
+func (m *Mysql) Finish() {
+	if !m.finished {
+		m.finished = true
+		m.finish()
+	}
 }
 
 func (m *Mysql) Close() {
-	if m.prepared {
+	m.Finish()
+	if m.stmt != nil {
 		m.stmt.Close()
 	}
+	m.commit()
+
+	// None of the rows are visible unless the staging table replaces the table
+	if m.cleanup == "staging" {
+		if m.uncommitted {
+			m.failed = m.rows
+			log.Errorf("Not replacing %s, %s is incomplete", m.target(), m.table())
+		} else if err := m.swap(); err != nil {
+			m.failed = m.rows
+			log.Error("Failed to swap in staging table: ", err)
+		} else {
+			log.Infof("Replaced %s with %s", m.target(), m.table())
+		}
+	}
 	m.db.Close()
+
+	if m.failed > 0 {
+		log.Warnf("Failed to write %d rows to MySQL", m.failed)
+	}
+}
+
+func (m *Mysql) Rollback() {
+	m.batch = m.batch[:0]
+	if m.load != nil && !m.finished {
+		m.load.abort()
+	}
+	if m.stmt != nil {
+		m.stmt.Close()
+	}
+	if m.commitBatch && m.cleanup != "staging" {
+		log.Warn("Committed batches are kept, rolling back the last batch only")
+	}
+	if m.tx != nil {
+		if err := m.tx.Rollback(); err != nil {
+			log.Error("Failed to roll back: ", err)
+		}
+		m.tx = nil
+		m.pending = 0
+	}
+	if m.cleanup == "staging" {
+		if _, err := m.db.Exec(m.stagingQueries()[0]); err != nil {
+			log.Error("Failed to drop staging table: ", err)
+		}
+	}
+	m.db.Close()
+}
+
+// Failed is the number of rows which could not be written.
+func (m *Mysql) Failed() uint {
+	return m.failed
+}
+
+func (m *Mysql) String() string {
+	return "MySQL"
+}
+
+// mysqlLoad streams rows to LOAD DATA LOCAL INFILE as tab separated text.  The statement
+// runs in the background reading from a pipe, which Write feeds.
+type mysqlLoad struct {
+	name string
+	w    *io.PipeWriter
+	done chan error
+	rows uint
+	err  error
+	// Rows the statement inserted, set once done
+	affected uint
+}
+
+func newMysqlLoad(table string, mode string, columns []string, exec func(string, ...interface{}) (sql.Result, error)) *mysqlLoad {
+	r, w := io.Pipe()
+	l := &mysqlLoad{
+		name: "metl-" + table,
+		w:    w,
+		done: make(chan error, 1),
+	}
+	mysql.RegisterReaderHandler(l.name, func() io.Reader {
+		return r
+	})
+
+	// LOAD DATA LOCAL skips rows with existing keys, unless replacing them
+	duplicates := ""
+	switch mode {
+	case "insertIgnore":
+		duplicates = "ignore "
+	case "replace":
+		duplicates = "replace "
+	}
+	query := fmt.Sprintf("load data local infile 'Reader::%s' %sinto table %s character set utf8mb4 (%s)", l.name, duplicates, table, strings.Join(columns, ","))
+	go func() {
+		res, err := exec(query)
+		if err == nil {
+			if n, e := res.RowsAffected(); e == nil {
+				l.affected = uint(n)
+			}
+		}
+		// Unblock writers if the statement failed before reading everything
+		r.CloseWithError(err)
+		l.done <- err
+	}()
+	return l
+}
+
+func (l *mysqlLoad) write(data []interface{}) {
+	fields := make([]string, len(data))
+	for i, v := range data {
+		fields[i] = loadDataValue(v)
+	}
+	l.rows++
+	if l.err != nil {
+		return
+	}
+	// The statement's error is returned by close
+	_, l.err = io.WriteString(l.w, strings.Join(fields, "\t")+"\n")
+}
+
+func (l *mysqlLoad) close() error {
+	l.w.Close()
+	err := <-l.done
+	mysql.DeregisterReaderHandler(l.name)
+	return err
+}
+
+func (l *mysqlLoad) abort() {
+	l.w.CloseWithError(fmt.Errorf("aborted"))
+	<-l.done
+	mysql.DeregisterReaderHandler(l.name)
+}
+
+var loadDataEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+// loadDataValue formats a value for LOAD DATA's default format, \N is NULL.
+func loadDataValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "\\N"
+	case bool:
+		if x {
+			return "1"
+		}
+		return "0"
+	}
+	return loadDataEscaper.Replace(formatValue(v))
+}
+
+// stringsOption reads a list of strings from an option, TOML arrays are decoded as
+// []interface{}.
+func stringsOption(option interface{}) []string {
+	list, _ := option.([]interface{})
+	s := make([]string, 0, len(list))
+	for _, v := range list {
+		s = append(s, fmt.Sprint(v))
+	}
+	return s
 }
@@ -0,0 +1,262 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMysqlInsertQuery(t *testing.T) {
+	m := &Mysql{
+		Options: map[string]interface{}{"table": "test"},
+		columns: []string{"a", "b"},
+	}
+
+	q := m.insertQuery(3)
+	if q != "insert into test (a,b) values (?,?),(?,?),(?,?)" {
+		t.Errorf("Unexpected query %s", q)
+	}
+}
+
+func TestMysqlBatchLimit(t *testing.T) {
+	data := []struct {
+		batchSize, columns, e int
+	}{
+		{1000, 10, 1000},
+		{1000, 66, 992},
+		{1000, 0, 1000},
+	}
+	for _, d := range data {
+		if n := mysqlBatchLimit(d.batchSize, d.columns); n != d.e {
+			t.Errorf("%d rows of %d columns: expecting %d, got %d", d.batchSize, d.columns, d.e, n)
+		}
+	}
+}
+
+func TestMysqlModeQueries(t *testing.T) {
+	m := &Mysql{
+		Options:    map[string]interface{}{"table": "test"},
+		columns:    []string{"date", "valuta", "kurs"},
+		keyColumns: []string{"date", "valuta"},
+	}
+
+	data := []struct {
+		mode string
+		e    string
+	}{
+		{"insertIgnore", "insert ignore into test (date,valuta,kurs) values (?,?,?)"},
+		{"replace", "replace into test (date,valuta,kurs) values (?,?,?)"},
+		{"upsert", "insert into test (date,valuta,kurs) values (?,?,?) on duplicate key update kurs=values(kurs)"},
+	}
+	for _, d := range data {
+		m.mode = d.mode
+		if q := m.insertQuery(1); q != d.e {
+			t.Errorf("%s: expecting %s, got %s", d.mode, d.e, q)
+		}
+	}
+
+	m.mode = "update"
+	if q := m.updateQuery(); q != "update test set kurs=? where date=? and valuta=?" {
+		t.Errorf("Unexpected query %s", q)
+	}
+	args := m.updateArgs([]interface{}{"2014-10-01", "EUR", 8.1})
+	if len(args) != 3 || args[0] != 8.1 || args[1] != "2014-10-01" || args[2] != "EUR" {
+		t.Errorf("Unexpected arguments %v", args)
+	}
+}
+
+func TestMysqlCheckUpdates(t *testing.T) {
+	data := []struct {
+		mode          string
+		updateColumns []string
+		ok            bool
+	}{
+		{"update", nil, false},
+		{"upsert", nil, false},
+		{"upsert", []string{"b"}, true},
+		{"insert", nil, true},
+	}
+	for _, d := range data {
+		m := &Mysql{mode: d.mode, columns: []string{"a", "b"}, keyColumns: []string{"a", "b"}, updateColumns: d.updateColumns}
+		if err := m.checkUpdates(); (err == nil) != d.ok {
+			t.Errorf("%s %v: unexpected error %v", d.mode, d.updateColumns, err)
+		}
+	}
+
+	// Columns from the first row are checked once known
+	m := &Mysql{mode: "update", keyColumns: []string{"a"}}
+	if err := m.checkUpdates(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestMysqlCleanupQueries(t *testing.T) {
+	m := &Mysql{
+		Options: map[string]interface{}{"table": "test"},
+	}
+	if q := m.cleanupQuery(); q != "" {
+		t.Errorf("Expecting no cleanup, got %s", q)
+	}
+
+	m.cleanup = "truncate"
+	if q := m.cleanupQuery(); q != "delete from test" {
+		t.Errorf("Unexpected query %s", q)
+	}
+
+	m.cleanup, m.cleanupWhere = "delete", "date = CURDATE()"
+	if q := m.cleanupQuery(); q != "delete from test where date = CURDATE()" {
+		t.Errorf("Unexpected query %s", q)
+	}
+
+	m.cleanup = "staging"
+	if m.table() != "test_tmp" {
+		t.Errorf("Expecting rows to be written to test_tmp, got %s", m.table())
+	}
+	q := m.stagingQueries()
+	if q[0] != "drop table if exists test_tmp" || q[1] != "create table test_tmp like test" {
+		t.Errorf("Unexpected queries %v", q)
+	}
+	q = m.swapQueries()
+	if len(q) != 3 || q[0] != "drop table if exists test_old" || q[1] != "rename table test to test_old, test_tmp to test" || q[2] != "drop table test_old" {
+		t.Errorf("Unexpected queries %v", q)
+	}
+}
+
+func TestMissingColumns(t *testing.T) {
+	missing := missingColumns([]string{"Date", "valuta"}, true, []string{"date", "kurs", "valuta"}, []string{"kurs", "id"})
+	if len(missing) != 2 || missing[0] != "kurs" || missing[1] != "id" {
+		t.Errorf("Expecting [kurs id], got %v", missing)
+	}
+}
+
+func TestStringsOption(t *testing.T) {
+	s := stringsOption([]interface{}{"a", "b"})
+	if len(s) != 2 || s[0] != "a" || s[1] != "b" {
+		t.Errorf("Expecting [a b], got %v", s)
+	}
+	if s := stringsOption(nil); len(s) != 0 {
+		t.Errorf("Expecting [], got %v", s)
+	}
+}
+
+// loadResult is the result of a LOAD DATA statement.
+type loadResult int64
+
+func (r loadResult) LastInsertId() (int64, error) { return 0, nil }
+func (r loadResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func TestMysqlLoadSkipped(t *testing.T) {
+	for mode, e := range map[string]uint{"insert": 2, "insertIgnore": 0} {
+		// The statement returns without reading, having inserted 1 row
+		exec := func(string, ...interface{}) (sql.Result, error) { return loadResult(1), nil }
+		m := &Mysql{mode: mode, load: newMysqlLoad("test", mode, []string{"a"}, exec)}
+		for i := 0; i < 3; i++ {
+			m.load.write([]interface{}{i})
+		}
+		m.finish()
+
+		if m.failed != e || m.pending != 3-e {
+			t.Errorf("%s: expecting %d failed, got %d (%d pending)", mode, e, m.failed, m.pending)
+		}
+	}
+}
+
+func TestMysqlUpdated(t *testing.T) {
+	if err := updated(loadResult(1)); err != nil {
+		t.Errorf("Expecting a matched row to be updated, got %v", err)
+	}
+	if err := updated(loadResult(0)); err == nil {
+		t.Error("Expecting error for a key matching no row, got nil")
+	}
+
+	for dsn, e := range map[string]string{
+		"user:pass@tcp(localhost:3306)/data":           "user:pass@tcp(localhost:3306)/data?clientFoundRows=true",
+		"user:pass@tcp(localhost:3306)/data?loc=Local": "user:pass@tcp(localhost:3306)/data?loc=Local&clientFoundRows=true",
+	} {
+		if v := mysqlFoundRows(dsn); v != e {
+			t.Errorf("Expecting %s, got %s", e, v)
+		}
+	}
+}
+
+func TestMysqlReject(t *testing.T) {
+	rejects, err := NewOutputRejects("test-mysql-rejects", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(rejects.Path()))
+
+	m := &Mysql{columns: []string{"id", "name"}}
+	m.SetRejects(rejects)
+	m.reject([]interface{}{int64(1), nil}, fmt.Errorf("no row with the key to update"))
+	if err := rejects.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.failed != 1 || rejects.Count() != 1 {
+		t.Errorf("Expecting 1 failed row saved, got %d (%d saved)", m.failed, rejects.Count())
+	}
+}
+
+func TestMysqlAbort(t *testing.T) {
+	deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+	for err, e := range map[error]bool{
+		deadlock: true,
+		&mysql.MySQLError{Number: 1205, Message: "Lock wait timeout"}: true,
+		&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}:   false,
+		driver.ErrBadConn: true,
+	} {
+		if mysqlAborts(err) != e {
+			t.Errorf("%v: expecting %v", err, e)
+		}
+	}
+
+	m := &Mysql{prepared: true, columns: []string{"a"}, batchSize: 10, pending: 5}
+	m.batch = [][]interface{}{{1}, {2}}
+	m.abort(deadlock)
+	if m.failed != 7 || m.pending != 0 || len(m.batch) != 0 || m.Aborted() == nil {
+		t.Errorf("Expecting 7 failed rows and an aborted output, got %d (%d pending, %v)", m.failed, m.pending, m.Aborted())
+	}
+
+	// Later rows are counted only
+	row := NewRowProcessed()
+	row.Set("a", int64(3))
+	m.Write(row)
+	if m.failed != 8 || len(m.batch) != 0 {
+		t.Errorf("Expecting 8 failed rows, got %d", m.failed)
+	}
+
+	multi := &MultiOutput{Names: []string{"csv", "db"}, Outputs: []Outputter{&Stdout{}, m}}
+	if err := multi.Aborted(); err == nil || !strings.HasPrefix(err.Error(), "db: ") {
+		t.Errorf("Expecting the aborted output to be named, got %v", err)
+	}
+}
+
+func TestLoadDataValue(t *testing.T) {
+	data := []struct {
+		v interface{}
+		e string
+	}{
+		{nil, "\\N"},
+		{true, "1"},
+		{int64(-3), "-3"},
+		{1.5, "1.5"},
+		{Decimal("10.10"), "10.10"},
+		{"a\tb\\c\nd", "a\\tb\\\\c\\nd"},
+		{time.Date(2014, 10, 1, 0, 0, 0, 0, time.UTC), "2014-10-01"},
+	}
+
+	for _, d := range data {
+		if v := loadDataValue(d.v); v != d.e {
+			t.Errorf("Expecting %s, got %s", d.e, v)
+		}
+	}
+}
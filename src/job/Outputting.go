@@ -6,7 +6,10 @@ package job
 
 import (
 	"fmt"
+	log "github.com/Sirupsen/logrus"
 	"os"
+	"sort"
+	"strings"
 )
 
 type Outputter interface {
@@ -15,6 +18,56 @@ type Outputter interface {
 	Close()
 }
 
+// Rollbacker is implemented by outputters which can discard everything written since Open.
+// It is called instead of Close when a run fails.
+type Rollbacker interface {
+	Rollback()
+}
+
+// ColumnSetter is implemented by outputters which need to know the output columns before
+// the first row is written.  Columns are nil when they are only known from the rows.
+type ColumnSetter interface {
+	SetColumns(columns []string)
+}
+
+// ColumnTyper is implemented by outputters which create tables.  Types are the column
+// types of the job (string, int, float, bool, decimal or date) by output column.
+type ColumnTyper interface {
+	SetColumnTypes(types map[string]string)
+}
+
+// RejectSetter is implemented by outputters which save the rows they failed to write to
+// the job's output reject file (see NewOutputRejects), which is closed after the output.
+type RejectSetter interface {
+	SetRejects(rejects *Rejects)
+}
+
+// Finisher is implemented by outputters which hold rows back, e.g. a last batch.  Finish
+// writes them without committing, so every failure is known before an output is committed
+// on Close, and a run failing because of them can still be rolled back.
+type Finisher interface {
+	Finish()
+}
+
+// FailureReporter is implemented by outputters which count the rows they failed to write.
+type FailureReporter interface {
+	Failed() uint
+}
+
+// Aborter is implemented by outputters whose transaction the server can roll back, e.g.
+// on a deadlock, losing rows which were already written.  An aborted output fails the run,
+// whether failing to write rows does or not.
+type Aborter interface {
+	Aborted() error
+}
+
+// RowRejecter is implemented by outputters which reject rows for their values, e.g. the
+// documents an index fails to map.  They are rejected rows of the run, counted once the
+// outputs are finished.
+type RowRejecter interface {
+	Rejected() uint
+}
+
 type Stdout struct{}
 
 func (s *Stdout) Write(row RowProcessed) {
@@ -23,3 +76,122 @@ func (s *Stdout) Write(row RowProcessed) {
 
 func (s *Stdout) Open()  {}
 func (s *Stdout) Close() {}
+
+func (s *Stdout) String() string {
+	return "STDOUT"
+}
+
+// MultiOutput writes every row to several outputs, in order.  All outputs are finished
+// before any is committed, and a failed run rolls back the outputs which support it and
+// closes the others.
+type MultiOutput struct {
+	Names   []string
+	Outputs []Outputter
+}
+
+func (m *MultiOutput) Open() {
+	for _, o := range m.Outputs {
+		o.Open()
+	}
+}
+
+func (m *MultiOutput) Write(row RowProcessed) {
+	for _, o := range m.Outputs {
+		o.Write(row)
+	}
+}
+
+func (m *MultiOutput) Finish() {
+	for _, o := range m.Outputs {
+		if f, ok := o.(Finisher); ok {
+			f.Finish()
+		}
+	}
+}
+
+func (m *MultiOutput) Close() {
+	for _, o := range m.Outputs {
+		o.Close()
+	}
+}
+
+func (m *MultiOutput) Rollback() {
+	for i, o := range m.Outputs {
+		if r, ok := o.(Rollbacker); ok {
+			r.Rollback()
+			continue
+		}
+		log.Warnf("Output %s does not support rollback, keeping written rows", m.Names[i])
+		o.Close()
+	}
+}
+
+// Failed is the number of rows the outputs failed to write, added up.
+func (m *MultiOutput) Failed() uint {
+	var failed uint
+	for _, n := range m.Failures() {
+		failed += n
+	}
+	return failed
+}
+
+// Failures returns the number of rows each output which reports failures failed to write.
+func (m *MultiOutput) Failures() map[string]uint {
+	failures := make(map[string]uint)
+	for i, o := range m.Outputs {
+		if f, ok := o.(FailureReporter); ok {
+			failures[m.Names[i]] = f.Failed()
+		}
+	}
+	return failures
+}
+
+// Rejected is the number of rows the outputs rejected, added up.
+func (m *MultiOutput) Rejected() uint {
+	var rejected uint
+	for _, o := range m.Outputs {
+		if r, ok := o.(RowRejecter); ok {
+			rejected += r.Rejected()
+		}
+	}
+	return rejected
+}
+
+// Aborted returns the first aborted output's error, naming the output.
+func (m *MultiOutput) Aborted() error {
+	for i, o := range m.Outputs {
+		if a, ok := o.(Aborter); ok {
+			if err := a.Aborted(); err != nil {
+				return fmt.Errorf("%s: %s", m.Names[i], err)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MultiOutput) String() string {
+	return strings.Join(m.Names, ", ")
+}
+
+// outputFailure returns an error naming the outputs which failed to write rows, nil when
+// none did.
+func outputFailure(o Outputter) error {
+	failures := make(map[string]uint)
+	if m, ok := o.(*MultiOutput); ok {
+		failures = m.Failures()
+	} else if f, ok := o.(FailureReporter); ok {
+		failures[fmt.Sprint(o)] = f.Failed()
+	}
+
+	failed := make([]string, 0)
+	for name, n := range failures {
+		if n > 0 {
+			failed = append(failed, fmt.Sprintf("%s (%d rows)", name, n))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("failed to write to %s", strings.Join(failed, ", "))
+}
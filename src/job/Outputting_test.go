@@ -6,8 +6,8 @@ package job
 
 func ExampleStdoutWrite() {
 
-	row := make(RowProcessed)
-	row["test"] = "test"
+	row := NewRowProcessed()
+	row.Set("test", "test")
 
 	out := &Stdout{}
 	out.Write(row)
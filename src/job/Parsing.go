@@ -5,37 +5,43 @@
 package job
 
 import (
-	"bytes"
 	"encoding/csv"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"math"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 )
 
-var (
-	templateFunctions = template.FuncMap{
-		"toUpper": strings.ToUpper,
-		"toLower": strings.ToLower,
-		"Now": func(format string) string {
-			return time.Now().Format(format)
-		},
-	}
-)
-
 type Parser interface {
 	Open(file string) error
 	Close()
 	Next() bool
 	Row() RowRaw
+	Line() int
 }
 
 type RowRaw interface {
-	Process(*ColumnMapper) RowProcessed
+	Process(*ColumnMapper) (RowProcessed, error)
 	AddColumn(key string, value string)
+	RemoveColumn(key string)
+	Get(key string) (string, bool)
+	Map() map[string]string
+	Clone() RowRaw
+}
+
+// RejectError is returned when a row is rejected while being processed.
+type RejectError struct {
+	Column string
+	Value  string
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("column %s: %s (value %q)", e.Column, e.Reason, e.Value)
 }
 
 type Row map[string]string
@@ -44,113 +50,334 @@ func (r Row) AddColumn(key string, value string) {
 	r[key] = value
 }
 
-func (r Row) Process(cm *ColumnMapper) RowProcessed {
-	row := make(RowProcessed)
+func (r Row) RemoveColumn(key string) {
+	delete(r, key)
+}
+
+func (r Row) Clone() RowRaw {
+	c := make(Row, len(r))
 	for k, v := range r {
-		m := (*cm).GetColumn(k)
-		if m.Discard == true {
-			continue
-		}
-
-		// Check the type of the variable received.  Everything in theory is a string and will
-		// be treated as a string when output, so we use the orignal values but check the type.
-		var err error
-		switch m.Type {
-		case "string", "variable":
-			// Do nothing.
-		case "int":
-			_, err = strconv.ParseInt(v, 0, 0)
-		case "bool":
-			// Convert valid true/false values to string value true or false
-			var x bool
-			x, err = strconv.ParseBool(v)
-			v = strconv.FormatBool(x)
-		case "float":
-			//var x float64
-			_, err = strconv.ParseFloat(v, 64)
-			//v = strconv.FormatFloat(x, 'f', m.Precision, 64)
-		default:
-			log.WithFields(log.Fields{
-				"type": m.Type,
-			}).Fatal("Received unexpected type")
-			return nil
+		c[k] = v
+	}
+	return c
+}
+
+func (r Row) Get(key string) (string, bool) {
+	v, ok := r[key]
+	return v, ok
+}
+
+func (r Row) Map() map[string]string {
+	return r
+}
+
+func (r Row) Process(cm *ColumnMapper) (RowProcessed, error) {
+	row := NewRowProcessed()
+
+	// Declared columns first, so the processed row is in column order
+	for _, m := range (*cm).Columns() {
+		v, ok := r[m.Name]
+		if !ok {
+			// Missing fields are set to their default value, if they have one
+			if m.Default == "" {
+				continue
+			}
+			v = m.Default
+		}
+		if err := processField(cm, m, v, &row); err != nil {
+			return RowProcessed{}, err
 		}
+	}
 
-		if err != nil && !m.AllowEmpty {
-			log.WithFields(log.Fields{
-				"status":    m.Failure,
-				"column":    m.Name,
-				"expecting": m.Type,
-				"value":     v,
-			}).Warn("Unexpected type when processing field")
-			if m.Failure == "reject" {
-				return nil
+	for k, v := range r {
+		if m := (*cm).GetColumn(k); m.Name == "" {
+			if err := processField(cm, m, v, &row); err != nil {
+				return RowProcessed{}, err
 			}
-			// Even though we have selected "keep", we still remove the invalid field.
-			// @todo - add option to actually use the field as well.
-			continue
 		}
+	}
+	return row, nil
+}
+
+// processField validates and transforms a single field, adding it to row.  The value is
+// converted to the column's type, unless it was transformed, looked up or protected
+// (hashed, tokenized or masked) in which case the resulting text is used.
+func processField(cm *ColumnMapper, m ProcessColumn, v string, row *RowProcessed) error {
+	if m.Discard == true {
+		return nil
+	}
 
-		// @todo - perhaps this code should execute for string types only ..?
+	if (*cm).IsNull(v) {
+		if m.Default != "" {
+			v = m.Default
+		} else if m.AllowEmpty || m.Type == "string" || m.Type == "variable" {
+			row.Set(m.Mapping, nil)
+			return nil
+		}
+		// Otherwise the null marker is validated like any other value (and fails).
+	}
 
-		strRune := []rune(v)
+	// Check the type of the variable received and convert it.
+	value, err := convertValue(m, v)
 
-		if m.Length != 0 && len(strRune) != m.Length {
-			log.WithFields(log.Fields{
-				"expected length": m.Length,
-				"actual length":   len(strRune),
-				"value":           v,
-			}).Warn("Row length check failed")
-			if m.Failure == "reject" {
-				return nil
-			}
+	// AllowEmpty only excuses empty values, not invalid ones.  Empty values which are not
+	// strings are null.
+	if err != nil && m.AllowEmpty && v == "" {
+		err = nil
+		value = nil
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"status":    m.Failure,
+			"column":    m.Name,
+			"expecting": m.Type,
+			"value":     m.shown(v),
+		}).Warn("Unexpected type when processing field")
+		return failField(m, v, row, "expecting "+m.Type)
+	}
+
+	// @todo - perhaps this code should execute for string types only ..?
+
+	strRune := []rune(v)
+
+	if m.Length != 0 && len(strRune) != m.Length {
+		log.WithFields(log.Fields{
+			"expected length": m.Length,
+			"actual length":   len(strRune),
+			"value":           m.shown(v),
+		}).Warn("Row length check failed")
+		if done, err := failCheck(m, v, row, fmt.Sprintf("expecting length %d, got %d", m.Length, len(strRune))); done {
+			return err
 		}
+	}
 
-		if len(m.CharacterRange) > 1 {
-			lo := []rune(m.CharacterRange[0])
-			hi := []rune(m.CharacterRange[1])
-
-			for _, r := range strRune {
-				if !(r >= lo[0] && r <= hi[0]) {
-					log.WithFields(log.Fields{
-						"lo":        m.CharacterRange[0],
-						"hi":        m.CharacterRange[1],
-						"character": string(r),
-					}).Warn("Character out of range")
-					if m.Failure == "reject" {
-						return nil
-					}
+	if len(m.CharacterRange) > 1 {
+		lo := []rune(m.CharacterRange[0])
+		hi := []rune(m.CharacterRange[1])
+
+		for _, r := range strRune {
+			if !(r >= lo[0] && r <= hi[0]) {
+				log.WithFields(log.Fields{
+					"lo":        m.CharacterRange[0],
+					"hi":        m.CharacterRange[1],
+					"character": string(r),
+				}).Warn("Character out of range")
+				if done, err := failCheck(m, v, row, fmt.Sprintf("character %q out of range %s-%s", r, m.CharacterRange[0], m.CharacterRange[1])); done {
+					return err
 				}
+				break
 			}
 		}
+	}
 
-		// Transformation stuff
-		if m.Transform != "" {
-			var t *template.Template
-			t, err = template.New("fields").Funcs(templateFunctions).Parse(m.Transform)
-			if err != nil {
-				log.Fatal(err)
+	// Transformation stuff
+	if m.Transform != "" {
+		transformed, err := transform(m.Transform, v)
+		if err != nil {
+			// Errors may quote the value
+			reason := "transform: " + err.Error()
+			if m.protected() {
+				reason = "transform failed"
 			}
-			var nv bytes.Buffer
-			err := t.Execute(&nv, v)
+			log.WithFields(log.Fields{
+				"status": m.Failure,
+				"column": m.Name,
+				"value":  m.shown(v),
+			}).Warn(reason)
+			return failField(m, v, row, reason)
+		}
+		v = transformed
+		value = v
+	}
+
+	if m.Lookup != "" {
+		l, _ := (*cm).GetLookup(m.Lookup)
+		if lv, ok := l[v]; ok {
+			value = lv
+		} else {
+			switch m.LookupMiss {
+			case "keep":
+				// Use the value as is.
+				value = v
+			case "default":
+				value = m.LookupDefault
+			default:
+				log.WithFields(log.Fields{
+					"column": m.Name,
+					"lookup": m.Lookup,
+					"value":  m.shown(v),
+				}).Warn("Value not found in lookup")
+				return &RejectError{m.Name, m.shown(v), "not found in lookup " + m.Lookup}
+			}
+		}
+	}
+
+	// Personal data is protected last, null and empty values stay as they are
+	if value != nil && formatValue(value) != "" {
+		if m.hashKey != nil {
+			value = hashValue(m.hashKey, formatValue(value))
+		}
+		if m.tokenizer != nil {
+			token, err := m.tokenizer.Token(formatValue(value))
 			if err != nil {
-				log.Fatal(err)
+				return &RejectError{m.Name, m.shown(v), fmt.Sprintf("token table %s: %s", m.tokenizer, err)}
 			}
-			v = nv.String()
+			value = token
+		}
+		if m.Mask {
+			value = maskValue(formatValue(value), m.MaskKeep, m.MaskChar)
+		}
+	}
+
+	row.Set(m.Mapping, value)
+	return nil
+}
+
+// parseInt parses an int as Go does, so 0x1F, 0o17, 0b101 and 1_000 are valid, except that
+// zero-padded numbers are decimal rather than octal.
+func parseInt(v string) (int64, error) {
+	digits := strings.TrimLeft(v, "+-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9' {
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return strconv.ParseInt(v, 0, 64)
+}
+
+// convertValue converts a field to the column's type.
+func convertValue(m ProcessColumn, v string) (interface{}, error) {
+	switch m.Type {
+	case "string", "variable":
+		return v, nil
+	case "int":
+		return parseInt(v)
+	case "bool":
+		return strconv.ParseBool(v)
+	case "float":
+		return parseFloat(v)
+	case "decimal":
+		return parseDecimal(v)
+	case "date":
+		layout := m.Format
+		if layout == "" {
+			layout = "2006-01-02"
+		}
+		return time.Parse(layout, v)
+	}
+
+	log.WithFields(log.Fields{
+		"type": m.Type,
+	}).Fatal("Received unexpected type")
+	return nil, nil
+}
+
+// parseFloat parses a finite float.  NaN and infinity are invalid, they can not be written
+// as JSON nor loaded into most databases.
+func parseFloat(v string) (float64, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return 0, fmt.Errorf("invalid float %q", v)
+	}
+	return f, err
+}
+
+var decimalNotation = regexp.MustCompile(`^([+-]?)([0-9]*)(?:\.([0-9]*))?([eE][+-]?[0-9]+)?$`)
+
+// parseDecimal validates a decimal number and writes it as a JSON number, without a plus
+// sign, superfluous leading zeros or a bare decimal point.  NaN and infinity are invalid.
+func parseDecimal(v string) (Decimal, error) {
+	m := decimalNotation.FindStringSubmatch(v)
+	if m == nil || m[2]+m[3] == "" {
+		return "", fmt.Errorf("invalid decimal %q", v)
+	}
+
+	d := strings.TrimLeft(m[2], "0")
+	if d == "" {
+		d = "0"
+	}
+	if m[1] == "-" {
+		d = "-" + d
+	}
+	if m[3] != "" {
+		d += "." + m[3]
+	}
+	return Decimal(d + m[4]), nil
+}
+
+// FailurePolicy returns what to do with invalid fields in a column: "reject" the row, or
+// keep it with the raw value ("keep-raw"), the column default ("keep-default") or null
+// ("keep-null", also used for "keep" and when no policy is set, except by the length and
+// character range checks which keep the value, see failCheck).  An empty string is returned
+// for unknown policies.
+func FailurePolicy(failure string) string {
+	switch failure {
+	case "", "keep", "keep-null":
+		return "keep-null"
+	case "reject", "keep-raw", "keep-default":
+		return failure
+	}
+	return ""
+}
+
+// failField applies the column's failure policy to an invalid field.  Kept fields are
+// noted on the row so the run report can count them.
+func failField(m ProcessColumn, v string, row *RowProcessed, reason string) error {
+	policy := FailurePolicy(m.Failure)
+	switch policy {
+	case "reject":
+		return &RejectError{m.Name, m.shown(v), reason}
+	case "keep-raw":
+		row.Set(m.Mapping, v)
+	case "keep-default":
+		// A default which is itself invalid is null
+		value, err := convertValue(m, m.Default)
+		if err != nil || m.Default == "" {
+			value = nil
 		}
+		row.Set(m.Mapping, value)
+	default:
+		row.Set(m.Mapping, nil)
+	}
+	row.kept = append(row.kept, fmt.Sprintf("%s (%s)", m.Name, policy))
+	return nil
+}
 
-		row[m.Mapping] = v
+// shown returns a value as it may be logged or saved to the reject file, the values of
+// protected columns are left out.
+func (m ProcessColumn) shown(v string) string {
+	if m.protected() {
+		return protectedValue
 	}
-	return row
+	return v
 }
 
-type RowProcessed map[string]string
+// failCheck applies the failure policy to a field failing its length or character range
+// check.  Without a policy, or with "keep", the value is kept as it always has been and the
+// field is processed further, so done is false.
+func failCheck(m ProcessColumn, v string, row *RowProcessed, reason string) (bool, error) {
+	if m.Failure == "" || m.Failure == "keep" {
+		row.kept = append(row.kept, fmt.Sprintf("%s (keep-raw)", m.Name))
+		return false, nil
+	}
+	return true, failField(m, v, row, reason)
+}
+
+// NewParser creates the parser for an engine.
+func NewParser(engine string, options map[string]interface{}) (Parser, error) {
+	switch engine {
+	case "csv":
+		return &CSVParser{
+			Options: options,
+		}, nil
+	}
+	return nil, fmt.Errorf("Parser %s does not exist", engine)
+}
 
 type CSVParser struct {
 	Options map[string]interface{}
 	file    *os.File
 	reader  *csv.Reader
 	next    RowRaw
+	line    int
 
 	headerRow []string
 }
@@ -192,6 +419,11 @@ func (p *CSVParser) Close() {
 	p.file.Close()
 }
 
+// Header returns the column names read from the header row, if any.
+func (p *CSVParser) Header() []string {
+	return p.headerRow
+}
+
 func (p *CSVParser) String() string {
 	return "CSV"
 }
@@ -213,6 +445,7 @@ func (p *CSVParser) Next() bool {
 
 	if len(next) > 0 {
 		rowExists = true
+		p.line, _ = p.reader.FieldPos(0)
 
 		row := make(Row)
 		for i := 0; i < len(next); i++ {
@@ -231,3 +464,8 @@ func (p *CSVParser) Next() bool {
 func (p *CSVParser) Row() RowRaw {
 	return p.next
 }
+
+// Line is the line number in the input file where the current row starts.
+func (p *CSVParser) Line() int {
+	return p.line
+}
@@ -3,7 +3,9 @@
 package job
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -212,13 +214,24 @@ func TestCSVParseSkipRow(t *testing.T) {
 	}
 }
 
+// checkReject checks that a row was rejected because of column.
+func checkReject(t *testing.T, err error, column string, reason string) {
+	re, ok := err.(*RejectError)
+	if !ok {
+		t.Fatalf("Expecting *RejectError, got %v", err)
+	}
+	if re.Column != column || re.Reason != reason {
+		t.Errorf("Expecting column %s rejected with %q, got %+v", column, reason, re)
+	}
+}
+
 func TestProcessMappingKeyChange(t *testing.T) {
 	row := make(Row)
 	row["int"] = "34"
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if k, ok := prow["INT"]; !ok {
+	if k, ok := prow.Lookup("INT"); !ok {
 		t.Errorf("Expecting int, got %v", k)
 	}
 }
@@ -227,10 +240,10 @@ func TestProcessIntType(t *testing.T) {
 	row := make(Row)
 	row["int"] = "34"
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if prow["INT"] != "34" {
-		t.Errorf("Expecting 34, got %v", prow["INT"])
+	if prow.Get("INT") != int64(34) {
+		t.Errorf("Expecting 34, got %v", prow.Get("INT"))
 	}
 }
 
@@ -238,9 +251,10 @@ func TestProcessIntReject(t *testing.T) {
 	row := make(Row)
 	row["int"] = "asdf"
 
-	prow := row.Process(&processor)
+	prow, err := row.Process(&processor)
+	checkReject(t, err, "int", "expecting int")
 
-	if prow != nil {
+	if prow.Values != nil {
 		t.Errorf("Expecting nil, got %v", prow)
 	}
 }
@@ -249,9 +263,9 @@ func TestProcessIntKeep(t *testing.T) {
 	row := make(Row)
 	row["intkeep"] = "asdf"
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if prow == nil {
+	if prow.Values == nil {
 		t.Errorf("Expecting empty map, got %v", prow)
 	}
 }
@@ -260,9 +274,9 @@ func TestProcessDiscard(t *testing.T) {
 	row := make(Row)
 	row["discard"] = "asdf"
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if prow == nil {
+	if prow.Values == nil {
 		t.Errorf("Expecting empty map, got %v", prow)
 	}
 }
@@ -271,10 +285,10 @@ func TestProcessStringTransformUpper(t *testing.T) {
 	row := make(Row)
 	row["stringupper"] = "asdf"
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if prow["STRINGUPPER"] != "ASDF" {
-		t.Errorf("Expecting ASDF, got %v", prow["STRINGUPPER"])
+	if prow.Get("STRINGUPPER") != "ASDF" {
+		t.Errorf("Expecting ASDF, got %v", prow.Get("STRINGUPPER"))
 	}
 }
 
@@ -282,10 +296,10 @@ func TestProcessStringTransformLower(t *testing.T) {
 	row := make(Row)
 	row["stringlower"] = "ASDF"
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if prow["STRINGLOWER"] != "asdf" {
-		t.Errorf("Expecting asdf, got %v", prow["STRINGLOWER"])
+	if prow.Get("STRINGLOWER") != "asdf" {
+		t.Errorf("Expecting asdf, got %v", prow.Get("STRINGLOWER"))
 	}
 }
 
@@ -293,10 +307,10 @@ func TestProcessBoolType(t *testing.T) {
 	row := make(Row)
 	row["bool"] = "T"
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if prow["BOOL"] != "true" {
-		t.Errorf("Expecting true, got %v", prow["BOOL"])
+	if prow.Get("BOOL") != true {
+		t.Errorf("Expecting true, got %v", prow.Get("BOOL"))
 	}
 }
 
@@ -304,9 +318,9 @@ func TestProcessBoolTypeInvalid(t *testing.T) {
 	row := make(Row)
 	row["bool"] = "A"
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if len(prow) > 1 {
+	if prow.Len() > 1 {
 		t.Errorf("Expecting empty Row, got %v", prow)
 	}
 }
@@ -315,10 +329,10 @@ func TestProcessFloatType(t *testing.T) {
 	row := make(Row)
 	row["float"] = "1.123"
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if prow["FLOAT"] != "1.123" {
-		t.Errorf("Expecting 1.123, got %v", prow["FLOAT"])
+	if prow.Get("FLOAT") != 1.123 {
+		t.Errorf("Expecting 1.123, got %v", prow.Get("FLOAT"))
 	}
 }
 
@@ -326,10 +340,21 @@ func TestProcessFloatTypeInvalid(t *testing.T) {
 	row := make(Row)
 	row["float"] = "1s"
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if prow["FLOAT"] != "" {
-		t.Errorf("Expecting \"\", got %v", prow["FLOAT"])
+	if prow.Get("FLOAT") != nil {
+		t.Errorf("Expecting nil, got %v", prow.Get("FLOAT"))
+	}
+}
+
+func TestProcessFloatTypeNotFinite(t *testing.T) {
+	for _, v := range []string{"NaN", "Inf", "-Infinity"} {
+		row := make(Row)
+		row["float"] = v
+
+		if _, err := row.Process(&processor); err == nil {
+			t.Errorf("Expecting %s to be rejected, got nil", v)
+		}
 	}
 }
 
@@ -337,10 +362,10 @@ func TestProcessAllowEmpty(t *testing.T) {
 	row := make(Row)
 	row["empty"] = ""
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if prow["EMPTY"] != "" {
-		t.Errorf("Expecting \"\", got %v", prow["EMPTY"])
+	if v, ok := prow.Lookup("EMPTY"); !ok || v != nil {
+		t.Errorf("Expecting nil, got %v", v)
 	}
 }
 
@@ -348,9 +373,10 @@ func TestProcessNotAllowEmpty(t *testing.T) {
 	row := make(Row)
 	row["int"] = ""
 
-	prow := row.Process(&processor)
+	prow, err := row.Process(&processor)
+	checkReject(t, err, "int", "expecting int")
 
-	if prow != nil {
+	if prow.Values != nil {
 		t.Errorf("Expecting nil, got %v", prow)
 	}
 }
@@ -359,10 +385,10 @@ func TestProcessLengthAccept(t *testing.T) {
 	row := make(Row)
 	row["length"] = "ABC"
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if prow["LENGTH"] != "ABC" {
-		t.Errorf("Expecting ABC, got %v", prow["LENGTH"])
+	if prow.Get("LENGTH") != "ABC" {
+		t.Errorf("Expecting ABC, got %v", prow.Get("LENGTH"))
 	}
 }
 
@@ -370,9 +396,10 @@ func TestProcessLengthFail(t *testing.T) {
 	row := make(Row)
 	row["length"] = "ABCD"
 
-	prow := row.Process(&processor)
+	prow, err := row.Process(&processor)
+	checkReject(t, err, "length", "expecting length 3, got 4")
 
-	if prow != nil {
+	if prow.Values != nil {
 		t.Errorf("Expecting nil, got %v", prow)
 	}
 }
@@ -381,10 +408,10 @@ func TestProcessCharacterRangeAccept(t *testing.T) {
 	row := make(Row)
 	row["cr"] = "ABCZ"
 
-	prow := row.Process(&processor)
+	prow, _ := row.Process(&processor)
 
-	if prow["CR"] != "ABCZ" {
-		t.Errorf("Expecting ABCZ, got %v", prow["CR"])
+	if prow.Get("CR") != "ABCZ" {
+		t.Errorf("Expecting ABCZ, got %v", prow.Get("CR"))
 	}
 }
 
@@ -392,9 +419,237 @@ func TestProcessCharacterRangeFail(t *testing.T) {
 	row := make(Row)
 	row["cr"] = "ABC:"
 
-	prow := row.Process(&processor)
+	prow, err := row.Process(&processor)
+	checkReject(t, err, "cr", `character ':' out of range A-Z`)
+
+	if prow.Values != nil {
+		t.Errorf("Expecting nil, got %v", prow)
+	}
+}
+
+func TestProcessRejectReason(t *testing.T) {
+	row := make(Row)
+	row["length"] = "ABCD"
+
+	_, err := row.Process(&processor)
+
+	re, ok := err.(*RejectError)
+	if !ok {
+		t.Fatalf("Expecting *RejectError, got %v", err)
+	}
+	if re.Column != "length" || re.Value != "ABCD" || re.Reason != "expecting length 3, got 4" {
+		t.Errorf("Unexpected reject error %+v", re)
+	}
+}
+
+func TestCSVLine(t *testing.T) {
+	options := make(map[string]interface{})
+	options["header"] = true
+	csv := &CSVParser{
+		Options: options,
+	}
+
+	err := csv.Open(fileLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer csv.Close()
+
+	csv.Next()
+	csv.Next()
+	if csv.Line() != 3 {
+		t.Errorf("Expecting 3, got %d", csv.Line())
+	}
+}
+
+func TestProcessNullValues(t *testing.T) {
+	cm := NewColumnMap()
+	cm.SetNullValues([]string{"", "NULL", "\\N"})
+	cm.AddColumn(ProcessColumn{Name: "string", Mapping: "STRING", Type: "string"})
+	cm.AddColumn(ProcessColumn{Name: "int", Mapping: "INT", Type: "int", Failure: "reject", AllowEmpty: true})
+	cm.AddColumn(ProcessColumn{Name: "intstrict", Mapping: "INTSTRICT", Type: "int", Failure: "reject"})
+	cm.AddColumn(ProcessColumn{Name: "default", Mapping: "DEFAULT", Type: "int", Failure: "reject", Default: "0"})
 
-	if prow != nil {
+	prow, err := Row{"string": "NULL", "int": "\\N", "default": ""}.Process(&cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"STRING", "INT"} {
+		if v, ok := prow.Lookup(k); !ok || v != nil {
+			t.Errorf("%s: expecting null, got %v", k, v)
+		}
+	}
+	if prow.Get("DEFAULT") != int64(0) {
+		t.Errorf("Expecting 0, got %v", prow.Get("DEFAULT"))
+	}
+
+	if _, err := (Row{"intstrict": "NULL"}).Process(&cm); err == nil {
+		t.Error("Expecting null in a column which does not allow empty values to reject the row")
+	}
+}
+
+func TestProcessMissingDefault(t *testing.T) {
+	cm := NewColumnMap()
+	cm.AddColumn(ProcessColumn{Name: "a", Mapping: "A", Type: "string"})
+	cm.AddColumn(ProcessColumn{Name: "b", Mapping: "B", Type: "string", Default: "none", Transform: "{{ toUpper . }}"})
+
+	prow, _ := Row{"a": "x"}.Process(&cm)
+
+	if prow.Get("B") != "NONE" {
+		t.Errorf("Expecting NONE, got %v", prow.Get("B"))
+	}
+}
+
+func TestProcessAllowEmptyInvalid(t *testing.T) {
+	row := make(Row)
+	row["empty"] = "abc"
+
+	prow, err := row.Process(&processor)
+	checkReject(t, err, "empty", "expecting float")
+
+	if prow.Values != nil {
 		t.Errorf("Expecting nil, got %v", prow)
 	}
 }
+
+func TestProcessFailurePolicy(t *testing.T) {
+	cm := NewColumnMap()
+	cm.AddColumn(ProcessColumn{Name: "raw", Mapping: "RAW", Type: "int", Failure: "keep-raw"})
+	cm.AddColumn(ProcessColumn{Name: "default", Mapping: "DEFAULT", Type: "int", Failure: "keep-default", Default: "-1"})
+	cm.AddColumn(ProcessColumn{Name: "null", Mapping: "NULL", Type: "int", Failure: "keep-null"})
+	cm.AddColumn(ProcessColumn{Name: "legacy", Mapping: "LEGACY", Type: "string", Failure: "keep", Length: 2})
+	cm.AddColumn(ProcessColumn{Name: "legacyint", Mapping: "LEGACYINT", Type: "int", Failure: "keep"})
+	cm.AddColumn(ProcessColumn{Name: "unset", Mapping: "UNSET", Type: "string", CharacterRange: []string{"a", "z"}, Transform: "{{ toUpper . }}"})
+
+	prow, err := Row{"raw": "x", "default": "x", "null": "x", "legacy": "abc", "legacyint": "x", "unset": "a1"}.Process(&cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Length and character range failures keep the value unless a policy says otherwise
+	expected := map[string]interface{}{"RAW": "x", "DEFAULT": int64(-1), "NULL": nil, "LEGACY": "abc", "LEGACYINT": nil, "UNSET": "A1"}
+	for k, e := range expected {
+		if v, ok := prow.Lookup(k); !ok || v != e {
+			t.Errorf("%s: expecting %v, got %v", k, e, v)
+		}
+	}
+	if len(prow.kept) != 6 {
+		t.Errorf("Expecting 6 kept fields, got %v", prow.kept)
+	}
+}
+
+func TestProcessTransformFailure(t *testing.T) {
+	cm := NewColumnMap()
+	date := `{{ parseDate "02.01.2006" . | formatDate "2006-01-02" }}`
+	cm.AddColumn(ProcessColumn{Name: "reject", Mapping: "REJECT", Type: "string", Transform: date, Failure: "reject"})
+	cm.AddColumn(ProcessColumn{Name: "raw", Mapping: "RAW", Type: "string", Transform: date, Failure: "keep-raw"})
+
+	_, err := Row{"reject": "31.02.2014"}.Process(&cm)
+	re, ok := err.(*RejectError)
+	if !ok {
+		t.Fatalf("Expecting *RejectError, got %v", err)
+	}
+	if re.Column != "reject" || re.Value != "31.02.2014" || !strings.HasPrefix(re.Reason, "transform: ") {
+		t.Errorf("Unexpected reject error %+v", re)
+	}
+
+	prow, err := Row{"raw": "31.02.2014"}.Process(&cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prow.Get("RAW") != "31.02.2014" || len(prow.kept) != 1 {
+		t.Errorf("Expecting the raw value to be kept, got %v %v", prow.Get("RAW"), prow.kept)
+	}
+}
+
+func TestProcessProtectedReject(t *testing.T) {
+	cm := NewColumnMap()
+	cm.AddColumn(ProcessColumn{Name: "ssn", Mapping: "SSN", Type: "int", Failure: "reject", hashKey: []byte("key")})
+	cm.AddColumn(ProcessColumn{Name: "born", Mapping: "BORN", Type: "string", Transform: `{{ parseDate "02.01.2006" . }}`, Failure: "reject", Mask: true})
+
+	_, err := Row{"ssn": "12O45"}.Process(&cm)
+	checkReject(t, err, "ssn", "expecting int")
+	if re := err.(*RejectError); re.Value != protectedValue {
+		t.Errorf("Expecting the value to be left out, got %q", re.Value)
+	}
+
+	// Errors quoting the value are left out as well
+	_, err = Row{"born": "31.02.1970"}.Process(&cm)
+	checkReject(t, err, "born", "transform failed")
+	if strings.Contains(err.Error(), "1970") {
+		t.Errorf("Expecting the value to be left out, got %s", err)
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	for failure, e := range map[string]string{"": "keep-null", "keep": "keep-null", "keep-raw": "keep-raw", "reject": "reject", "drop": ""} {
+		if p := FailurePolicy(failure); p != e {
+			t.Errorf("%q: expecting %q, got %q", failure, e, p)
+		}
+	}
+}
+
+func TestProcessPersonalData(t *testing.T) {
+	cm := NewColumnMap()
+	cm.AddColumn(ProcessColumn{Name: "email", Mapping: "EMAIL", Type: "string", Transform: "{{ toLower . }}", hashKey: []byte("key")})
+	cm.AddColumn(ProcessColumn{Name: "phone", Mapping: "PHONE", Type: "int", Mask: true, MaskKeep: 4})
+
+	prow, err := Row{"email": "Ola@Example.com", "phone": "98761234"}.Process(&cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := hashValue([]byte("key"), "ola@example.com"); prow.Get("EMAIL") != e {
+		t.Errorf("Expecting %s, got %v", e, prow.Get("EMAIL"))
+	}
+	if prow.Get("PHONE") != "****1234" {
+		t.Errorf("Expecting ****1234, got %v", prow.Get("PHONE"))
+	}
+
+	// Null values are not protected
+	cm.AddColumn(ProcessColumn{Name: "id", Mapping: "ID", Type: "int", AllowEmpty: true, hashKey: []byte("key")})
+	prow, err = Row{"id": ""}.Process(&cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := prow.Lookup("ID"); !ok || v != nil {
+		t.Errorf("Expecting null, got %v", v)
+	}
+}
+
+func TestParseInt(t *testing.T) {
+	valid := map[string]int64{"42": 42, "-7": -7, "0x1F": 31, "0o17": 15, "0b101": 5, "1_000": 1000, "012": 12, "-09": -9}
+	for v, e := range valid {
+		if n, err := parseInt(v); err != nil || n != e {
+			t.Errorf("%s: expecting %d, got %d %v", v, e, n, err)
+		}
+	}
+	for _, v := range []string{"", "1.5", "0x", "abc", "9223372036854775808"} {
+		if _, err := parseInt(v); err == nil {
+			t.Errorf("%s: expecting an error", v)
+		}
+	}
+}
+
+func TestParseDecimal(t *testing.T) {
+	valid := map[string]string{
+		"1.50": "1.50", "+1.5": "1.5", ".5": "0.5", "-.5": "-0.5", "1.": "1", "007": "7",
+		"0": "0", "-0.0": "-0.0", "1e5": "1e5", "1.E-2": "1E-2",
+	}
+	for v, e := range valid {
+		d, err := parseDecimal(v)
+		if err != nil || string(d) != e {
+			t.Errorf("%s: expecting %s, got %s %v", v, e, d, err)
+		}
+		if b, _ := json.Marshal(d); !json.Valid(b) {
+			t.Errorf("%s: invalid JSON %s", v, b)
+		}
+	}
+
+	for _, v := range []string{"", ".", "-", "NaN", "Inf", "-Infinity", "0x1p-2", "1_000", "1e", " 1"} {
+		if d, err := parseDecimal(v); err == nil {
+			t.Errorf("%q: expecting an error, got %s", v, d)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+)
+
+func TestPostgresMergeQuery(t *testing.T) {
+	p := &Postgres{
+		schema:     "public",
+		table:      "test",
+		columns:    []string{"date", "valuta", "kurs"},
+		keyColumns: []string{"date", "valuta"},
+	}
+
+	insert := `insert into "public"."test" ("date","valuta","kurs") `
+	last := `select distinct on ("date","valuta") "date","valuta","kurs" from "metl_load" order by "date","valuta",ctid desc`
+	data := []struct {
+		mode string
+		e    string
+	}{
+		{"insertIgnore", insert + `select "date","valuta","kurs" from "metl_load" on conflict do nothing`},
+		{"upsert", insert + last + ` on conflict ("date","valuta") do update set "kurs"=excluded."kurs"`},
+		{"replace", insert + last + ` on conflict ("date","valuta") do update set "kurs"=excluded."kurs"`},
+		{"update", `update "public"."test" t set "kurs"=l."kurs" from (` + last + `) l where t."date"=l."date" and t."valuta"=l."valuta"`},
+	}
+	for _, d := range data {
+		p.mode = d.mode
+		if q := p.mergeQuery(); q != d.e {
+			t.Errorf("%s: expecting %s, got %s", d.mode, d.e, q)
+		}
+	}
+
+	p.mode = "upsert"
+	p.updateColumns = []string{"valuta"}
+	e := insert + last + ` on conflict ("date","valuta") do update set "valuta"=excluded."valuta"`
+	if q := p.mergeQuery(); q != e {
+		t.Errorf("Expecting %s, got %s", e, q)
+	}
+}
+
+func TestPostgresUnmatchedQuery(t *testing.T) {
+	p := &Postgres{
+		schema:     "public",
+		table:      "test",
+		mode:       "update",
+		columns:    []string{"date", "valuta", "kurs"},
+		keyColumns: []string{"date", "valuta"},
+	}
+	e := `select l."date"::text,l."valuta"::text,l."kurs"::text from "metl_load" l where not exists (select 1 from "public"."test" t where t."date"=l."date" and t."valuta"=l."valuta")`
+	if q := p.unmatchedQuery(); q != e {
+		t.Errorf("Expecting %s, got %s", e, q)
+	}
+}
+
+func TestPostgresGrantQuery(t *testing.T) {
+	data := []struct {
+		public    bool
+		grantee   string
+		grantable bool
+		e         string
+	}{
+		{true, "", false, `grant SELECT on "data"."test_tmp" to public`},
+		{false, "reader", false, `grant SELECT on "data"."test_tmp" to "reader"`},
+		{false, "admin", true, `grant SELECT on "data"."test_tmp" to "admin" with grant option`},
+	}
+	for _, d := range data {
+		if q := grantQuery(`"data"."test_tmp"`, d.public, d.grantee, "SELECT", d.grantable); q != d.e {
+			t.Errorf("Expecting %s, got %s", d.e, q)
+		}
+	}
+}
+
+func TestPostgresCheckUpdates(t *testing.T) {
+	data := []struct {
+		mode          string
+		updateColumns []string
+		ok            bool
+	}{
+		{"update", nil, false},
+		{"replace", nil, false},
+		{"upsert", nil, false},
+		{"upsert", []string{"b"}, true},
+		{"insertIgnore", nil, true},
+	}
+	for _, d := range data {
+		p := &Postgres{mode: d.mode, columns: []string{"a", "b"}, keyColumns: []string{"a", "b"}, updateColumns: d.updateColumns}
+		if err := p.checkUpdates(); (err == nil) != d.ok {
+			t.Errorf("%s %v: unexpected error %v", d.mode, d.updateColumns, err)
+		}
+	}
+
+	p := &Postgres{mode: "update", columns: []string{"a", "b"}, keyColumns: []string{"a"}}
+	if err := p.checkUpdates(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestPostgresSetupQueries(t *testing.T) {
+	p := &Postgres{schema: "data", table: "test", mode: "insert"}
+
+	if q := p.setupQueries(); len(q) != 0 {
+		t.Errorf("Expecting no queries, got %v", q)
+	}
+
+	p.cleanup = "truncate"
+	if q := p.setupQueries(); len(q) != 1 || q[0] != `delete from "data"."test"` {
+		t.Errorf("Unexpected queries %v", q)
+	}
+
+	p.cleanup = "delete"
+	p.cleanupWhere = "date >= '2014-01-01'"
+	if q := p.setupQueries(); len(q) != 1 || q[0] != `delete from "data"."test" where date >= '2014-01-01'` {
+		t.Errorf("Unexpected queries %v", q)
+	}
+
+	p.cleanup = "staging"
+	p.mode = "upsert"
+	q := p.setupQueries()
+	if len(q) != 3 ||
+		q[0] != `drop table if exists "data"."test_tmp"` ||
+		q[1] != `create table "data"."test_tmp" (like "data"."test" including all)` ||
+		q[2] != `create temporary table "metl_load" (like "data"."test" including defaults) on commit drop` {
+		t.Errorf("Unexpected queries %v", q)
+	}
+
+	q = p.swapQueries()
+	if len(q) != 4 ||
+		q[0] != `drop table if exists "data"."test_old"` ||
+		q[1] != `alter table "data"."test" rename to "test_old"` ||
+		q[2] != `alter table "data"."test_tmp" rename to "test"` ||
+		q[3] != `drop table "data"."test_old"` {
+		t.Errorf("Unexpected queries %v", q)
+	}
+}
+
+func TestMissingColumnsExact(t *testing.T) {
+	missing := missingColumns([]string{"Date", "valuta"}, false, []string{"date", "valuta"})
+	if len(missing) != 1 || missing[0] != "date" {
+		t.Errorf("Expecting [date], got %v", missing)
+	}
+}
+
+// TestPostgresLoad runs against a local database, e.g.
+// METL_TEST_POSTGRES_DSN="postgres://localhost/metl_test?sslmode=disable"
+func TestPostgresLoad(t *testing.T) {
+	dsn := os.Getenv("METL_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("METL_TEST_POSTGRES_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, q := range []string{
+		"drop view if exists metl_test_view",
+		"drop table if exists metl_test",
+		"create table metl_test (id serial, date date, valuta text, kurs numeric, primary key (date, valuta))",
+		"insert into metl_test values ('2014-01-01', 'EUR', 8.1), ('2014-01-01', 'USD', 6.1)",
+		"grant select on metl_test to public",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer db.Exec("drop table if exists metl_test")
+	defer db.Exec("drop view if exists metl_test_view")
+
+	row := func(valuta string, kurs string) RowProcessed {
+		r := NewRowProcessed()
+		r.Set("date", "2014-01-01")
+		r.Set("valuta", valuta)
+		r.Set("kurs", Decimal(kurs))
+		return r
+	}
+
+	data := []struct {
+		options map[string]interface{}
+		rows    []RowProcessed
+		e       string
+	}{
+		{map[string]interface{}{"mode": "upsert", "keyColumns": []interface{}{"date", "valuta"}},
+			[]RowProcessed{row("EUR", "8.0"), row("SEK", "0.9"), row("EUR", "8.2")}, "EUR 8.2,SEK 0.9,USD 6.1"},
+		{map[string]interface{}{"mode": "insertIgnore"},
+			[]RowProcessed{row("EUR", "8.3"), row("DKK", "1.1")}, "DKK 1.1,EUR 8.2,SEK 0.9,USD 6.1"},
+		{map[string]interface{}{"mode": "update", "keyColumns": []interface{}{"date", "valuta"}},
+			[]RowProcessed{row("EUR", "8.3"), row("NOK", "1.0")}, "DKK 1.1,EUR 8.3,SEK 0.9,USD 6.1"},
+		{map[string]interface{}{"cleanup": "staging"},
+			[]RowProcessed{row("EUR", "8.4")}, "EUR 8.4"},
+		{map[string]interface{}{"cleanup": "truncate"},
+			[]RowProcessed{row("USD", "6.2"), row("USD", "6.3")}, "EUR 8.4"},
+	}
+	for _, d := range data {
+		d.options["dsn"] = dsn
+		d.options["table"] = "metl_test"
+		p := &Postgres{Options: d.options}
+		p.SetColumns([]string{"date", "valuta", "kurs"})
+		p.Open()
+		for _, r := range d.rows {
+			p.Write(r)
+		}
+		p.Close()
+
+		rows, err := db.Query("select valuta, kurs from metl_test order by valuta")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := ""
+		for rows.Next() {
+			var valuta, kurs string
+			rows.Scan(&valuta, &kurs)
+			if result != "" {
+				result += ","
+			}
+			result += valuta + " " + kurs
+		}
+		rows.Close()
+		if result != d.e {
+			t.Errorf("%v: expecting %s, got %s", d.options, d.e, result)
+		}
+		if d.options["mode"] == "update" && p.Failed() != 1 {
+			t.Errorf("Expecting the row with no key to update to fail, got %d failed", p.Failed())
+		}
+	}
+
+	// The staging table was given the privileges of the table
+	var granted bool
+	if err := db.QueryRow("select has_table_privilege('public', 'metl_test', 'select')").Scan(&granted); err != nil || !granted {
+		t.Errorf("Expecting select to be granted to public, got %v %v", granted, err)
+	}
+
+	// The serial column still has its sequence after the staging table was swapped in
+	if _, err := db.Exec("insert into metl_test (date, valuta, kurs) values ('2014-01-02', 'EUR', 8.5)"); err != nil {
+		t.Errorf("Expecting the sequence to be kept, got %s", err)
+	}
+
+	// A view on the table keeps it from being dropped, the load is rolled back
+	if _, err := db.Exec("create view metl_test_view as select * from metl_test"); err != nil {
+		t.Fatal(err)
+	}
+	p := &Postgres{Options: map[string]interface{}{"dsn": dsn, "table": "metl_test", "cleanup": "staging"}}
+	p.SetColumns([]string{"date", "valuta", "kurs"})
+	p.Open()
+	p.Write(row("SEK", "0.8"))
+	p.Close()
+	var n int
+	db.QueryRow("select count(*) from metl_test").Scan(&n)
+	if p.Failed() != 1 || n != 2 {
+		t.Errorf("Expecting the load to fail and the table to be kept, got %d failed and %d rows", p.Failed(), n)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode"
+)
+
+var (
+	// Token tables are stored in this directory, readable by the metl user only
+	tokensDirectory string = "tokens"
+
+	// Attempts at finding an unused token before giving up
+	tokenAttempts = 100
+
+	noToken = errors.New("no unused token found")
+)
+
+// LoadSecret reads a key from "env:NAME" (an environment variable) or "file:PATH" (a
+// secrets file, relative paths are resolved from dir).  Surrounding whitespace is removed.
+func LoadSecret(source string, dir string) ([]byte, error) {
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("secret %q: expecting env:NAME or file:PATH", source)
+	}
+
+	var key []byte
+	switch parts[0] {
+	case "env":
+		key = []byte(os.Getenv(parts[1]))
+	case "file":
+		file := parts[1]
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		var err error
+		if key, err = ioutil.ReadFile(file); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("secret %q: unknown source %s", source, parts[0])
+	}
+
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("secret %q is empty", source)
+	}
+	return key, nil
+}
+
+// hashValue returns the hex encoded HMAC-SHA256 of v.
+func hashValue(key []byte, v string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// maskValue replaces all but the last keep characters of v with char (default *).
+func maskValue(v string, keep int, char string) string {
+	if char == "" {
+		char = "*"
+	}
+	r := []rune(v)
+	if keep >= len(r) {
+		return v
+	}
+	if keep < 0 {
+		keep = 0
+	}
+	return strings.Repeat(char, len(r)-keep) + string(r[len(r)-keep:])
+}
+
+// Tokenizer replaces values with random tokens of the same format: digits are replaced by
+// digits, letters by letters of the same case and everything else is kept, so a phone
+// number stays a phone number.  The same value always gets the same token.  The mapping
+// is stored in local storage, so tokens can be looked up again by those with access to it.
+type Tokenizer struct {
+	sync.Mutex
+
+	name   string
+	path   string
+	tokens map[string]string
+	values map[string]string
+
+	file *os.File
+	csv  *csv.Writer
+}
+
+// OpenTokenizer loads a token table, creating it if it does not exist.
+func OpenTokenizer(name string) (*Tokenizer, error) {
+	dir := filepath.Join(getStoragePath(), tokensDirectory)
+	if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return nil, err
+	}
+
+	t := &Tokenizer{
+		name:   name,
+		path:   filepath.Join(dir, name+".csv"),
+		tokens: make(map[string]string),
+		values: make(map[string]string),
+	}
+
+	var err error
+	t.file, err = os.OpenFile(t.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, os.FileMode(0600))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(t.file.Fd()), syscall.LOCK_SH); err != nil {
+		t.file.Close()
+		return nil, err
+	}
+	err = t.read()
+	syscall.Flock(int(t.file.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		t.file.Close()
+		return nil, err
+	}
+
+	t.csv = csv.NewWriter(t.file)
+	return t, nil
+}
+
+// read adds the records written to the table since it was last read.  Each record is
+// value, token.
+func (t *Tokenizer) read() error {
+	reader := csv.NewReader(t.file)
+	reader.FieldsPerRecord = 2
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("token table %s: %s", t.name, err)
+		}
+		t.tokens[record[0]] = record[1]
+		t.values[record[1]] = record[0]
+	}
+}
+
+// Token returns the token for v, creating and storing a new one if needed.  Jobs running
+// at the same time may share a token table, so new tokens are created with the table
+// locked, after reading the tokens added by the others.
+func (t *Tokenizer) Token(v string) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if token, ok := t.tokens[v]; ok {
+		return token, nil
+	}
+
+	if err := syscall.Flock(int(t.file.Fd()), syscall.LOCK_EX); err != nil {
+		return "", err
+	}
+	defer syscall.Flock(int(t.file.Fd()), syscall.LOCK_UN)
+	if err := t.read(); err != nil {
+		return "", err
+	}
+	if token, ok := t.tokens[v]; ok {
+		return token, nil
+	}
+
+	// A token equal to the value would store it in clear text, unless there is nothing
+	// to replace
+	replaceable := strings.IndexFunc(v, func(c rune) bool {
+		return unicode.IsDigit(c) || unicode.IsLetter(c)
+	}) >= 0
+
+	for i := 0; i < tokenAttempts; i++ {
+		token, err := newToken(v)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := t.values[token]; ok || (token == v && replaceable) {
+			continue
+		}
+
+		// Store the token before it is used, so it can always be looked up
+		if err := t.csv.Write([]string{v, token}); err != nil {
+			return "", err
+		}
+		t.csv.Flush()
+		if err := t.csv.Error(); err != nil {
+			return "", err
+		}
+
+		t.tokens[v] = token
+		t.values[token] = v
+		return token, nil
+	}
+	return "", noToken
+}
+
+// Value returns the value a token was created for.
+func (t *Tokenizer) Value(token string) (string, bool) {
+	t.Lock()
+	defer t.Unlock()
+	v, ok := t.values[token]
+	return v, ok
+}
+
+// Detokenize looks up the value of a token in an existing token table.
+func Detokenize(name string, token string) (string, error) {
+	path := filepath.Join(getStoragePath(), tokensDirectory, name+".csv")
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("token table %s: %s", name, err)
+	}
+
+	t, err := OpenTokenizer(name)
+	if err != nil {
+		return "", err
+	}
+	defer t.Close()
+
+	v, ok := t.Value(token)
+	if !ok {
+		return "", fmt.Errorf("token table %s: unknown token %s", name, token)
+	}
+	return v, nil
+}
+
+func (t *Tokenizer) Len() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.tokens)
+}
+
+func (t *Tokenizer) Close() error {
+	return t.file.Close()
+}
+
+func (t *Tokenizer) String() string {
+	return t.name
+}
+
+func newToken(v string) (string, error) {
+	token := []rune(v)
+	for i, c := range token {
+		var chars string
+		switch {
+		case unicode.IsDigit(c):
+			chars = "0123456789"
+		case unicode.IsUpper(c):
+			chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+		case unicode.IsLetter(c):
+			chars = "abcdefghijklmnopqrstuvwxyz"
+		default:
+			continue
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		token[i] = rune(chars[n.Int64()])
+	}
+	return string(token), nil
+}
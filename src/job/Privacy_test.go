@@ -0,0 +1,145 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestLoadSecret(t *testing.T) {
+	os.Setenv("METL_TEST_SECRET", " secret\n")
+	defer os.Unsetenv("METL_TEST_SECRET")
+
+	key, err := LoadSecret("env:METL_TEST_SECRET", "")
+	if err != nil || string(key) != "secret" {
+		t.Errorf("Expecting secret, got %q (%v)", key, err)
+	}
+
+	for _, source := range []string{"METL_TEST_SECRET", "env:METL_TEST_MISSING", "vault:x", "file:missing.key"} {
+		if _, err := LoadSecret(source, "../../test_data"); err == nil {
+			t.Errorf("%s: expecting error, got nil", source)
+		}
+	}
+}
+
+func TestHashValue(t *testing.T) {
+	h := hashValue([]byte("key"), "The quick brown fox jumps over the lazy dog")
+	if h != "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8" {
+		t.Errorf("Unexpected hash %s", h)
+	}
+	if hashValue([]byte("other"), "x") == hashValue([]byte("key"), "x") {
+		t.Error("Expecting hashes to depend on the key")
+	}
+}
+
+func TestMaskValue(t *testing.T) {
+	data := []struct {
+		value string
+		keep  int
+		char  string
+		e     string
+	}{
+		{"98761234", 4, "", "****1234"},
+		{"98761234", 0, "#", "########"},
+		{"123", 4, "", "123"},
+		{"æøå", 1, "", "**å"},
+	}
+
+	for _, d := range data {
+		if m := maskValue(d.value, d.keep, d.char); m != d.e {
+			t.Errorf("%s: expecting %s, got %s", d.value, d.e, m)
+		}
+	}
+}
+
+func TestTokenizer(t *testing.T) {
+	tk, err := OpenTokenizer("test-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tk.path)
+
+	token, err := tk.Token("+47 987-65 432 Ola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^\+\d\d \d\d\d-\d\d \d\d\d [A-Z][a-z][a-z]$`).MatchString(token) {
+		t.Errorf("Expecting the same format, got %s", token)
+	}
+	if again, _ := tk.Token("+47 987-65 432 Ola"); again != token {
+		t.Errorf("Expecting %s, got %s", token, again)
+	}
+	tk.Close()
+
+	// The mapping is kept between runs
+	if v, err := Detokenize("test-tokens", token); err != nil || v != "+47 987-65 432 Ola" {
+		t.Errorf("Expecting the original value, got %q (%v)", v, err)
+	}
+	if _, err := Detokenize("test-tokens", "unknown"); err == nil {
+		t.Error("Expecting error for unknown token, got nil")
+	}
+	if _, err := Detokenize("test-missing", token); err == nil {
+		t.Error("Expecting error for missing table, got nil")
+	}
+}
+
+func TestTokenizerExhausted(t *testing.T) {
+	tk, err := OpenTokenizer("test-exhausted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tk.path)
+	defer tk.Close()
+
+	for _, v := range []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "٥"} {
+		if _, err := tk.Token(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// All single digit tokens are in use
+	if _, err := tk.Token("٦"); err != noToken {
+		t.Errorf("Expecting %v, got %v", noToken, err)
+	}
+}
+
+func TestTokenizerNotValue(t *testing.T) {
+	tk, err := OpenTokenizer("test-not-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tk.path)
+	defer tk.Close()
+
+	for _, v := range []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "a", "B", "-"} {
+		token, err := tk.Token(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token == v && v != "-" {
+			t.Errorf("Expecting a token other than the value, got %s", token)
+		}
+	}
+}
+
+func TestTokenizerShared(t *testing.T) {
+	first, err := OpenTokenizer("test-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(first.path)
+	defer first.Close()
+	second, err := OpenTokenizer("test-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	// Tokens added by another job are used
+	a, _ := first.Token("Ola Nordmann")
+	b, _ := second.Token("Ola Nordmann")
+	if a == "" || a != b {
+		t.Errorf("Expecting the same token, got %s and %s", a, b)
+	}
+}
@@ -11,21 +11,33 @@ import (
 type ColumnMapper interface {
 	AddColumn(ProcessColumn)
 	GetColumn(string) ProcessColumn
+	Columns() []ProcessColumn
+	AddLookup(string, Lookup)
+	GetLookup(string) (Lookup, bool)
+	SetNullValues([]string)
+	IsNull(string) bool
 }
 
 // @todo locking
 type ColumnMap struct {
-	columns map[string]ProcessColumn
+	columns    map[string]ProcessColumn
+	order      []string
+	lookups    map[string]Lookup
+	nullValues map[string]bool
 }
 
 func NewColumnMap() ColumnMapper {
 	return &ColumnMap{
 		columns: make(map[string]ProcessColumn),
+		lookups: make(map[string]Lookup),
 	}
 }
 
 // @todo check if column exists already or not
 func (cm *ColumnMap) AddColumn(column ProcessColumn) {
+	if _, ok := cm.columns[column.Name]; !ok {
+		cm.order = append(cm.order, column.Name)
+	}
 	cm.columns[column.Name] = column
 
 	log.WithFields(log.Fields{
@@ -44,3 +56,33 @@ func (cm *ColumnMap) GetColumn(name string) ProcessColumn {
 	}
 	return ProcessColumn{}
 }
+
+// Columns returns the columns in the order they were added.
+func (cm *ColumnMap) Columns() []ProcessColumn {
+	columns := make([]ProcessColumn, len(cm.order))
+	for i, name := range cm.order {
+		columns[i] = cm.columns[name]
+	}
+	return columns
+}
+
+func (cm *ColumnMap) AddLookup(name string, lookup Lookup) {
+	cm.lookups[name] = lookup
+}
+
+func (cm *ColumnMap) GetLookup(name string) (Lookup, bool) {
+	l, ok := cm.lookups[name]
+	return l, ok
+}
+
+// SetNullValues sets the markers which are read as null, e.g. "", "NULL" or "\\N".
+func (cm *ColumnMap) SetNullValues(values []string) {
+	cm.nullValues = make(map[string]bool)
+	for _, v := range values {
+		cm.nullValues[v] = true
+	}
+}
+
+func (cm *ColumnMap) IsNull(value string) bool {
+	return cm.nullValues[value]
+}
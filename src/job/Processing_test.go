@@ -19,3 +19,26 @@ func TestMapAddGetColumn(t *testing.T) {
 		t.Errorf("Expecting ProcessColumn, got %v", col)
 	}
 }
+
+func TestMapColumnsOrder(t *testing.T) {
+	processor := NewColumnMap()
+	for _, name := range []string{"c", "a", "b", "a"} {
+		processor.AddColumn(ProcessColumn{
+			Name: name,
+		})
+	}
+
+	columns := processor.Columns()
+	if len(columns) != 3 || columns[0].Name != "c" || columns[1].Name != "a" || columns[2].Name != "b" {
+		t.Errorf("Expecting columns c, a, b, got %v", columns)
+	}
+}
+
+func TestMapIsNull(t *testing.T) {
+	processor := NewColumnMap()
+	processor.SetNullValues([]string{"NULL", "-"})
+
+	if !processor.IsNull("-") || processor.IsNull("") {
+		t.Error("Expecting only NULL and - to be null values")
+	}
+}
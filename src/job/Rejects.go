@@ -0,0 +1,247 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// Rejected rows of the latest run are stored in this directory
+	rejectsDirectory string = "rejects"
+	rejectsFile      string = "latest"
+	// Rows the outputs failed to write, with the output columns
+	outputRejectsFile string = "output"
+	// Replaces the values of protected columns in logs and reject files
+	protectedValue = "(protected)"
+
+	noRejects = errors.New("no rejects found")
+)
+
+// Rejects quarantines rejected rows in the job's storage directory, either as CSV or as
+// newline delimited JSON.  The file is written to a temporary file and only replaces the
+// previous run's rejects when closed.
+type Rejects struct {
+	sync.Mutex
+
+	format string
+	path   string
+	file   *os.File
+	csv    *csv.Writer
+	json   *json.Encoder
+
+	columns   []string
+	protected []string
+	count     uint
+}
+
+type rejectRecord struct {
+	Line   int               `json:"line"`
+	Column string            `json:"column"`
+	Reason string            `json:"reason"`
+	Value  string            `json:"value"`
+	Row    map[string]string `json:"row"`
+}
+
+// NewRejects creates the reject file for a job, format is either csv (default) or ndjson.
+func NewRejects(jobName string, format string) (*Rejects, error) {
+	return newRejects(jobName, rejectsFile, format)
+}
+
+// NewOutputRejects creates the file for rows the outputs failed to write.  They are kept
+// apart from the rows rejected while processing, as their columns are the output columns.
+func NewOutputRejects(jobName string, format string) (*Rejects, error) {
+	return newRejects(jobName, outputRejectsFile, format)
+}
+
+func newRejects(jobName string, name string, format string) (*Rejects, error) {
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		return nil, fmt.Errorf("unknown rejects format %s", format)
+	}
+
+	dir := filepath.Join(getStoragePath(), rejectsDirectory, jobName)
+	if err := os.MkdirAll(dir, os.FileMode(0750)); err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(dir, "tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rejects{
+		format: format,
+		path:   filepath.Join(dir, name+"."+format),
+		file:   file,
+	}
+	if format == "csv" {
+		r.csv = csv.NewWriter(file)
+	} else {
+		r.json = json.NewEncoder(file)
+	}
+
+	return r, nil
+}
+
+// Protect sets the columns holding personal data, their values are not saved.
+func (r *Rejects) Protect(columns []string) {
+	r.protected = columns
+}
+
+// Write quarantines a row together with its line number and the reason it was rejected.
+func (r *Rejects) Write(line int, row RowRaw, reason error) {
+	record := rejectRecord{
+		Line:   line,
+		Reason: reason.Error(),
+		Row:    row.Map(),
+	}
+	if re, ok := reason.(*RejectError); ok {
+		record.Column = re.Column
+		record.Reason = re.Reason
+		record.Value = re.Value
+	}
+	if len(r.protected) > 0 {
+		record.Row = make(map[string]string, len(record.Row))
+		for k, v := range row.Map() {
+			if inStrings(r.protected, k) {
+				v = protectedValue
+			}
+			record.Row[k] = v
+		}
+		if inStrings(r.protected, record.Column) {
+			record.Value = protectedValue
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	var err error
+	if r.json != nil {
+		err = r.json.Encode(record)
+	} else {
+		err = r.writeCSV(record)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file": r.file.Name(),
+		}).Warn("Unable to write rejected row: ", err)
+		return
+	}
+	r.count++
+}
+
+// The CSV columns are taken from the first rejected row.  Columns later rows have in
+// addition, e.g. the items of an unpivoted row or columns added by a script, are written
+// as a JSON object to the last column, extra.
+func (r *Rejects) writeCSV(record rejectRecord) error {
+	if r.columns == nil {
+		r.columns = make([]string, 0, len(record.Row))
+		for k := range record.Row {
+			r.columns = append(r.columns, k)
+		}
+		sort.Strings(r.columns)
+
+		header := append([]string{"line", "column", "reason", "value"}, r.columns...)
+		if err := r.csv.Write(append(header, "extra")); err != nil {
+			return err
+		}
+	}
+
+	fields := []string{strconv.Itoa(record.Line), record.Column, record.Reason, record.Value}
+	for _, c := range r.columns {
+		fields = append(fields, record.Row[c])
+	}
+
+	extra := make(map[string]string)
+	for k, v := range record.Row {
+		if !inStrings(r.columns, k) {
+			extra[k] = v
+		}
+	}
+	if len(extra) == 0 {
+		return r.csv.Write(append(fields, ""))
+	}
+	b, err := json.Marshal(extra)
+	if err != nil {
+		return err
+	}
+	return r.csv.Write(append(fields, string(b)))
+}
+
+// Count is the number of rows written to the reject file.
+func (r *Rejects) Count() uint {
+	r.Lock()
+	defer r.Unlock()
+	return r.count
+}
+
+// Path is the location of the reject file once closed.
+func (r *Rejects) Path() string {
+	return r.path
+}
+
+// Close replaces the previous run's reject file.
+func (r *Rejects) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.csv != nil {
+		r.csv.Flush()
+		if err := r.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	// Only keep the latest run's rejects, regardless of format.
+	name := strings.TrimSuffix(filepath.Base(r.path), "."+r.format)
+	old, _ := filepath.Glob(filepath.Join(filepath.Dir(r.path), name+".*"))
+	for _, f := range old {
+		if f != r.path {
+			os.Remove(f)
+		}
+	}
+
+	return os.Rename(r.file.Name(), r.path)
+}
+
+// LatestRejects returns the location of the reject file written by a job's latest run.
+func LatestRejects(jobName string) (string, error) {
+	return latestRejects(jobName, rejectsFile)
+}
+
+// LatestOutputRejects returns the location of the file with the rows the outputs failed
+// to write in a job's latest run.
+func LatestOutputRejects(jobName string) (string, error) {
+	return latestRejects(jobName, outputRejectsFile)
+}
+
+func latestRejects(jobName string, name string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(getStoragePath(), rejectsDirectory, jobName, name+".*"))
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", noRejects
+	}
+	return files[0], nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRejectsCSV(t *testing.T) {
+	r, err := NewRejects("test-rejects", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(r.Path()))
+
+	r.Write(3, Row{"b": "2", "a": "x"}, &RejectError{"a", "x", "expecting int"})
+	r.Write(7, Row{"a": "y"}, &RejectError{"a", "y", "expecting int"})
+	// Columns the first row does not have are kept as JSON
+	r.Write(9, Row{"a": "z", "c": "3,4", "d": "5"}, &RejectError{"a", "z", "expecting int"})
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := LatestRejects("test-rejects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(path) != "latest.csv" {
+		t.Errorf("Expecting latest.csv, got %s", path)
+	}
+
+	f, _ := ioutil.ReadFile(path)
+	expected := "line,column,reason,value,a,b,extra\n3,a,expecting int,x,x,2,\n7,a,expecting int,y,y,,\n" +
+		`9,a,expecting int,z,z,,"{""c"":""3,4"",""d"":""5""}"` + "\n"
+	if string(f) != expected {
+		t.Errorf("Expecting %q, got %q", expected, string(f))
+	}
+	if r.Count() != 3 {
+		t.Errorf("Expecting 3, got %d", r.Count())
+	}
+}
+
+func TestRejectsNDJSONReplacesPrevious(t *testing.T) {
+	r, err := NewRejects("test-rejects-json", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(r.Path()))
+	r.Close()
+
+	r, err = NewRejects("test-rejects-json", "ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write(2, Row{"a": "x"}, &RejectError{"a", "x", "expecting int"})
+	r.Close()
+
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(r.Path()), "*"))
+	if len(files) != 1 || filepath.Base(files[0]) != "latest.ndjson" {
+		t.Fatalf("Expecting only latest.ndjson, got %v", files)
+	}
+
+	f, _ := ioutil.ReadFile(files[0])
+	expected := `{"line":2,"column":"a","reason":"expecting int","value":"x","row":{"a":"x"}}` + "\n"
+	if string(f) != expected {
+		t.Errorf("Expecting %q, got %q", expected, string(f))
+	}
+}
+
+func TestOutputRejects(t *testing.T) {
+	r, err := NewRejects("test-rejects-output", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(r.Path()))
+	o, err := NewOutputRejects("test-rejects-output", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rows rejected while processing and rows an output failed to write have other columns
+	r.Write(3, Row{"A": "x"}, &RejectError{"A", "x", "expecting int"})
+	o.Write(0, Row{"id": "1"}, fmt.Errorf("output: 400 Bad Request"))
+	r.Close()
+	o.Close()
+
+	path, _ := LatestRejects("test-rejects-output")
+	f, _ := ioutil.ReadFile(path)
+	if string(f) != "line,column,reason,value,A,extra\n3,A,expecting int,x,x,\n" {
+		t.Errorf("Unexpected rejects %q", string(f))
+	}
+	path, err = LatestOutputRejects("test-rejects-output")
+	if err != nil || filepath.Base(path) != "output.csv" {
+		t.Fatalf("Expecting output.csv, got %s %v", path, err)
+	}
+	f, _ = ioutil.ReadFile(path)
+	if string(f) != "line,column,reason,value,id,extra\n0,,output: 400 Bad Request,,1,\n" {
+		t.Errorf("Unexpected output rejects %q", string(f))
+	}
+}
+
+func TestRejectsProtect(t *testing.T) {
+	r, err := NewRejects("test-rejects-protect", "ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(r.Path()))
+	r.Protect([]string{"email"})
+
+	row := Row{"email": "a@example.com", "n": "x"}
+	r.Write(2, row, &RejectError{"email", "a@example.com", "not found in lookup users"})
+	r.Close()
+
+	f, _ := ioutil.ReadFile(r.Path())
+	expected := `{"line":2,"column":"email","reason":"not found in lookup users","value":"(protected)","row":{"email":"(protected)","n":"x"}}` + "\n"
+	if string(f) != expected {
+		t.Errorf("Expecting %q, got %q", expected, string(f))
+	}
+	if row["email"] != "a@example.com" {
+		t.Errorf("Expecting the row to be left as it is, got %v", row)
+	}
+}
+
+func TestRejectsInvalidFormat(t *testing.T) {
+	if _, err := NewRejects("test-rejects", "xml"); err == nil {
+		t.Error("Expecting error, got nil")
+	}
+}
+
+func TestLatestRejectsMissing(t *testing.T) {
+	if _, err := LatestRejects("test-rejects-missing"); err != noRejects {
+		t.Errorf("Expecting %v, got %v", noRejects, err)
+	}
+}
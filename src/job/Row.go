@@ -0,0 +1,141 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// RowProcessed holds the processed fields in column order.  Values are typed according to
+// the column definition: nil (null), string, int64, float64, Decimal, bool or time.Time.
+type RowProcessed struct {
+	Columns []string
+	Values  map[string]interface{}
+
+	// Invalid fields kept by their column's failure policy, as "column (policy)"
+	kept []string
+}
+
+func NewRowProcessed() RowProcessed {
+	return RowProcessed{
+		Columns: make([]string, 0),
+		Values:  make(map[string]interface{}),
+	}
+}
+
+// Set adds or replaces a column's value, new columns are added last.
+func (r *RowProcessed) Set(column string, value interface{}) {
+	if _, ok := r.Values[column]; !ok {
+		r.Columns = append(r.Columns, column)
+	}
+	r.Values[column] = value
+}
+
+// Get returns a column's value, nil when it is null or missing.
+func (r RowProcessed) Get(column string) interface{} {
+	return r.Values[column]
+}
+
+// Lookup returns a column's value and whether the column is present.
+func (r RowProcessed) Lookup(column string) (interface{}, bool) {
+	v, ok := r.Values[column]
+	return v, ok
+}
+
+func (r RowProcessed) Len() int {
+	return len(r.Columns)
+}
+
+func (r RowProcessed) String() string {
+	return fmt.Sprint(r.Values)
+}
+
+// Select returns a row with the given columns only, in order, and dates formatted as text
+// for outputs which have no date type.
+func (r RowProcessed) Select(columns []string) RowProcessed {
+	out := NewRowProcessed()
+	for _, c := range columns {
+		v := r.Get(c)
+		if t, ok := v.(time.Time); ok {
+			v = formatValue(t)
+		}
+		out.Set(c, v)
+	}
+	return out
+}
+
+// Raw returns the row as text fields, nulls are empty.
+func (r RowProcessed) Raw() Row {
+	raw := make(Row, len(r.Columns))
+	for _, c := range r.Columns {
+		raw[c] = formatValue(r.Get(c))
+	}
+	return raw
+}
+
+// MarshalJSON encodes the row as an object with the columns in order.
+func (r RowProcessed) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, c := range r.Columns {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(r.Values[c])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Decimal is a validated number kept with all its digits, so no precision is lost
+// on its way to the output.
+type Decimal string
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d), nil
+}
+
+func (d Decimal) Value() (driver.Value, error) {
+	return string(d), nil
+}
+
+// formatValue formats a processed value as text, null values are empty.
+func formatValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case Decimal:
+		return string(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	case time.Time:
+		if x.Hour() == 0 && x.Minute() == 0 && x.Second() == 0 && x.Nanosecond() == 0 {
+			return x.Format("2006-01-02")
+		}
+		return x.Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,303 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"fmt"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Script runs a Lua function on every processed row, for logic which is too complex for
+// column transforms.  Rows are processed first, so rows rejected by their column rules
+// never reach the script.  The script must define a global function
+//
+//	function process(row, raw)
+//
+// where row holds the processed values (null values are left out) and raw the input row.
+// It returns either a row table, a list of row tables or nil for no rows.  Returning nil
+// and a message rejects the row, e.g. `return nil, "unknown customer"`.  Columns of the
+// processed row which are missing from a returned row are null.  Returned values are
+// converted back to the type of their column, see SetColumns.
+//
+// Lua states are not safe for concurrent use, so each worker gets its own.
+type Script struct {
+	file   string
+	proto  *lua.FunctionProto
+	states chan *lua.LState
+	// Columns holding typed values by mapped name
+	columns map[string]ProcessColumn
+}
+
+// NewScript compiles a script file and creates a Lua state for each of workers.
+func NewScript(file string, workers int) (*Script, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	chunk, err := parse.Parse(f, file)
+	if err != nil {
+		return nil, fmt.Errorf("script %s: %s", file, err)
+	}
+	proto, err := lua.Compile(chunk, file)
+	if err != nil {
+		return nil, fmt.Errorf("script %s: %s", file, err)
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	s := &Script{
+		file:   file,
+		proto:  proto,
+		states: make(chan *lua.LState, workers),
+	}
+	for i := 0; i < workers; i++ {
+		L, err := s.newState()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.states <- L
+	}
+	return s, nil
+}
+
+// SetColumns declares the job's columns, so decimal and date values, which the script gets
+// as strings, are returned as decimals and dates.  Columns which are transformed, looked up
+// or protected hold text, their values are returned as they are.
+func (s *Script) SetColumns(columns []ProcessColumn) {
+	s.columns = make(map[string]ProcessColumn)
+	for _, c := range columns {
+		if c.Discard || c.Transform != "" || c.Lookup != "" || c.protected() {
+			continue
+		}
+		s.columns[c.Mapping] = c
+	}
+}
+
+func (s *Script) newState() (*lua.LState, error) {
+	L := lua.NewState()
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("script %s: %s", s.file, err)
+	}
+	if _, ok := L.GetGlobal("process").(*lua.LFunction); !ok {
+		L.Close()
+		return nil, fmt.Errorf("script %s: missing function process", s.file)
+	}
+	return L, nil
+}
+
+// Run calls the script's process function, returning the resulting rows.  Rejections and
+// script errors are returned as a *RejectError for the column "script".
+func (s *Script) Run(raw RowRaw, row RowProcessed) ([]RowProcessed, error) {
+	L := <-s.states
+	defer func() { s.states <- L }()
+
+	// Only the values actually returned are on the stack, missing ones are nil
+	top := L.GetTop()
+	err := L.CallByParam(lua.P{
+		Fn:      L.GetGlobal("process"),
+		NRet:    lua.MultRet,
+		Protect: true,
+	}, processedToTable(L, row), rawToTable(L, raw))
+	if err != nil {
+		return nil, &RejectError{Column: "script", Reason: fmt.Sprintf("%s", err)}
+	}
+
+	var ret, reason lua.LValue = lua.LNil, lua.LNil
+	if n := L.GetTop() - top; n > 0 {
+		ret = L.Get(top + 1)
+		if n > 1 {
+			reason = L.Get(top + 2)
+		}
+	}
+	L.SetTop(top)
+
+	if reason != lua.LNil {
+		return nil, &RejectError{Column: "script", Reason: reason.String()}
+	}
+
+	t, ok := ret.(*lua.LTable)
+	if !ok {
+		if ret != lua.LNil {
+			return nil, &RejectError{Column: "script", Reason: fmt.Sprintf("expecting a table, got %s", ret.Type())}
+		}
+		return nil, nil
+	}
+
+	// An empty list has no rows
+	if k, _ := t.Next(lua.LNil); k == lua.LNil {
+		return nil, nil
+	}
+
+	// A list of rows
+	if first, ok := t.RawGetInt(1).(*lua.LTable); ok && first != nil {
+		rows := make([]RowProcessed, 0, t.Len())
+		for i := 1; i <= t.Len(); i++ {
+			r, ok := t.RawGetInt(i).(*lua.LTable)
+			if !ok {
+				return nil, &RejectError{Column: "script", Reason: fmt.Sprintf("row %d is not a table", i)}
+			}
+			out, err := s.tableToProcessed(r, row)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, out)
+		}
+		return rows, nil
+	}
+
+	out, err := s.tableToProcessed(t, row)
+	if err != nil {
+		return nil, err
+	}
+	return []RowProcessed{out}, nil
+}
+
+func (s *Script) Close() {
+	for {
+		select {
+		case L := <-s.states:
+			L.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (s *Script) String() string {
+	return s.file
+}
+
+func rawToTable(L *lua.LState, raw RowRaw) *lua.LTable {
+	t := L.NewTable()
+	for k, v := range raw.Map() {
+		t.RawSetString(k, lua.LString(v))
+	}
+	return t
+}
+
+func processedToTable(L *lua.LState, row RowProcessed) *lua.LTable {
+	t := L.NewTable()
+	for _, c := range row.Columns {
+		switch v := row.Get(c).(type) {
+		case nil:
+			// Lua tables can not hold nil values
+		case int64:
+			t.RawSetString(c, lua.LNumber(v))
+		case float64:
+			t.RawSetString(c, lua.LNumber(v))
+		case bool:
+			t.RawSetString(c, lua.LBool(v))
+		default:
+			t.RawSetString(c, lua.LString(formatValue(v)))
+		}
+	}
+	return t
+}
+
+// tableToProcessed converts a returned row, keeping the column order of the processed row
+// the script was called with.  New columns are added in name order.  Lua has a single
+// number type, so numbers are converted back to the type of the original column.  Values
+// of decimal and date columns which can not be converted reject the row.
+func (s *Script) tableToProcessed(t *lua.LTable, orig RowProcessed) (RowProcessed, error) {
+	values := make(map[string]interface{})
+	var err error
+	t.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		var value interface{}
+		c := s.column(k.String(), orig.Get(k.String()))
+		switch x := v.(type) {
+		case lua.LNumber:
+			// Whole numbers are integers, unless the column is a float
+			value = float64(x)
+			if c.Type == "decimal" {
+				value, err = typed(c, strconv.FormatFloat(float64(x), 'f', -1, 64))
+			} else if c.Type != "float" && float64(x) == float64(int64(x)) {
+				value = int64(x)
+			}
+		case lua.LBool:
+			value = bool(x)
+		case lua.LString:
+			value, err = typed(c, string(x))
+		default:
+			value = v.String()
+		}
+		values[k.String()] = value
+	})
+	if err != nil {
+		return RowProcessed{}, &RejectError{Column: "script", Reason: err.Error()}
+	}
+
+	row := NewRowProcessed()
+	for _, c := range orig.Columns {
+		row.Set(c, values[c])
+		delete(values, c)
+	}
+
+	added := make([]string, 0, len(values))
+	for c := range values {
+		added = append(added, c)
+	}
+	sort.Strings(added)
+	for _, c := range added {
+		row.Set(c, values[c])
+	}
+	return row, nil
+}
+
+// column returns the declared column of a returned value, typed by the value the column
+// held when the script was called if it was not declared.
+func (s *Script) column(name string, orig interface{}) ProcessColumn {
+	c, ok := s.columns[name]
+	if !ok {
+		c.Name = name
+		switch orig.(type) {
+		case float64:
+			c.Type = "float"
+		case Decimal:
+			c.Type = "decimal"
+		case time.Time:
+			c.Type = "date"
+		}
+	}
+	return c
+}
+
+// typed converts a returned string to a decimal or date for such columns.
+func typed(c ProcessColumn, v string) (interface{}, error) {
+	switch c.Type {
+	case "decimal":
+		d, err := parseDecimal(v)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %s", c.Name, err)
+		}
+		return d, nil
+	case "date":
+		// Dates are passed to the script as formatValue writes them, or may be returned in
+		// the column's format
+		for _, layout := range []string{"2006-01-02", "2006-01-02 15:04:05", c.Format} {
+			if layout == "" {
+				continue
+			}
+			if d, err := time.Parse(layout, v); err == nil {
+				return d, nil
+			}
+		}
+		return nil, fmt.Errorf("column %s: invalid date %q", c.Name, v)
+	}
+	return v, nil
+}
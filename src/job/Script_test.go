@@ -0,0 +1,130 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func scriptRow() RowProcessed {
+	row := NewRowProcessed()
+	row.Set("id", int64(1))
+	row.Set("amount", 60.0)
+	row.Set("note", nil)
+	return row
+}
+
+func TestScriptRun(t *testing.T) {
+	s, err := NewScript("../../test_data/script.lua", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	rows, err := s.Run(Row{"items": "a,b", "status": "ok"}, scriptRow())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Expecting 2 rows, got %v", rows)
+	}
+
+	r := rows[1]
+	expected := []string{"id", "amount", "note", "item", "vip"}
+	for i, c := range expected {
+		if i >= len(r.Columns) || r.Columns[i] != c {
+			t.Fatalf("Expecting columns %v, got %v", expected, r.Columns)
+		}
+	}
+	if r.Get("id") != int64(1) || r.Get("amount") != 120.0 || r.Get("note") != nil || r.Get("item") != "b" || r.Get("vip") != false {
+		t.Errorf("Unexpected row %v", r)
+	}
+}
+
+func TestScriptReject(t *testing.T) {
+	s, err := NewScript("../../test_data/script.lua", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, err = s.Run(Row{"items": "a", "status": "cancelled"}, scriptRow())
+	if re, ok := err.(*RejectError); !ok || re.Column != "script" || re.Reason != "order cancelled" {
+		t.Errorf("Expecting order cancelled, got %v", err)
+	}
+
+	// Runtime errors reject the row, items is missing
+	if _, err = s.Run(Row{"status": "ok"}, scriptRow()); err == nil {
+		t.Error("Expecting error, got nil")
+	}
+
+	// No rows
+	empty := NewRowProcessed()
+	empty.Set("id", int64(2))
+	if rows, err := s.Run(Row{"items": "a"}, empty); err != nil || len(rows) != 0 {
+		t.Errorf("Expecting no rows, got %v (%v)", rows, err)
+	}
+
+	// An empty list, no items
+	if rows, err := s.Run(Row{"items": "", "status": "ok"}, scriptRow()); err != nil || len(rows) != 0 {
+		t.Errorf("Expecting no rows for an empty list, got %v (%v)", rows, err)
+	}
+}
+
+func TestScriptInvalid(t *testing.T) {
+	if _, err := NewScript("../../test_data/missing.lua", 1); err == nil {
+		t.Error("Expecting error for missing file, got nil")
+	}
+	if _, err := NewScript("../../test_data/test.csv", 1); err == nil {
+		t.Error("Expecting error for invalid script, got nil")
+	}
+}
+
+func TestScriptTypes(t *testing.T) {
+	f, err := ioutil.TempFile("", "metl-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`function process(row, raw)
+  row.total = 2.5
+  row.day = raw.day
+  return row
+end`)
+	f.Close()
+
+	s, err := NewScript(f.Name(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetColumns([]ProcessColumn{
+		{Name: "total", Mapping: "total", Type: "decimal"},
+		{Name: "day", Mapping: "day", Type: "date"},
+		{Name: "code", Mapping: "code", Type: "decimal", Transform: "{{.}}"},
+	})
+
+	row := NewRowProcessed()
+	row.Set("price", Decimal("10.50"))
+	row.Set("total", nil)
+	row.Set("day", nil)
+	row.Set("code", "007")
+
+	rows, err := s.Run(Row{"day": "2024-02-03"}, row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rows[0]
+	day := time.Date(2024, 2, 3, 0, 0, 0, 0, time.UTC)
+	if r.Get("price") != Decimal("10.50") || r.Get("total") != Decimal("2.5") || r.Get("day") != day || r.Get("code") != "007" {
+		t.Errorf("Unexpected row %v", r)
+	}
+
+	_, err = s.Run(Row{"day": "tomorrow"}, row)
+	if re, ok := err.(*RejectError); !ok || re.Column != "script" {
+		t.Errorf("Expecting an invalid date to be rejected, got %v", err)
+	}
+}
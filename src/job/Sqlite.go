@@ -0,0 +1,301 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+
+// Package job provides local job information and access.
+package job
+
+import (
+	"database/sql"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sqlite writes rows into a table of a local SQLite database file, for ad hoc analysis and
+// for testing jobs without a database server.  The rows are inserted in a single
+// transaction, committed on Close.  Rows which fail to insert are saved to the output reject
+// file.  All rows are counted as failed when the commit fails.
+//
+// With createTable the table is created when it does not exist, using the column types of
+// the job and keyColumns as its primary key.  Jobs with a script create it from the values
+// of the first row.  The replace and insertIgnore modes need a key, so they require
+// keyColumns when the table is created.
+//
+//	[job.outputting.options]
+//	file = "/tmp/currencies.db"
+//	table = "currencies"
+//	createTable = true
+//	keyColumns = ["date", "valuta"]
+//	mode = "replace"
+//	cleanup = "truncate"
+type Sqlite struct {
+	Options map[string]interface{}
+
+	db   *sql.DB
+	tx   *sql.Tx
+	stmt *sql.Stmt
+
+	table       string
+	mode        string
+	createTable bool
+	keyColumns  []string
+
+	columns []string
+	types   map[string]string
+	// Rows written in the transaction
+	pending uint
+	failed  uint
+	rejects *Rejects
+}
+
+// SetColumns sets the columns written, in order.  Without them the columns of the first
+// row are used.
+func (s *Sqlite) SetColumns(columns []string) {
+	s.columns = columns
+}
+
+// SetColumnTypes sets the types used when creating the table.
+func (s *Sqlite) SetColumnTypes(types map[string]string) {
+	s.types = types
+}
+
+// SetRejects sets where rows which fail to be inserted are saved.
+func (s *Sqlite) SetRejects(rejects *Rejects) {
+	s.rejects = rejects
+}
+
+func (s *Sqlite) Write(row RowProcessed) {
+	if s.stmt == nil {
+		s.prepare(row)
+	}
+
+	data := make([]interface{}, len(s.columns))
+	for i, c := range s.columns {
+		data[i] = sqliteValue(row.Get(c))
+	}
+	if _, err := s.stmt.Exec(data...); err != nil {
+		s.reject(data, err)
+		log.Warn("Failed to insert row: ", err)
+		return
+	}
+	s.pending++
+}
+
+// reject counts a row which failed to be inserted and saves it to the reject file, if set.
+func (s *Sqlite) reject(data []interface{}, err error) {
+	s.failed++
+	if s.rejects == nil {
+		return
+	}
+	raw := make(Row, len(s.columns))
+	for i, c := range s.columns {
+		raw[c] = formatValue(data[i])
+	}
+	s.rejects.Write(0, raw, fmt.Errorf("output: %s", err))
+}
+
+// prepare creates the table when needed and prepares the insert.
+func (s *Sqlite) prepare(row RowProcessed) {
+	if s.columns == nil {
+		s.columns = make([]string, 0)
+		for _, k := range row.Columns {
+			s.columns = append(s.columns, k)
+		}
+	}
+
+	if s.createTable {
+		if _, err := s.tx.Exec(s.createQuery(row)); err != nil {
+			log.Fatal("Unable to create table: ", err)
+		}
+	}
+
+	var err error
+	if s.stmt, err = s.tx.Prepare(s.insertQuery()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// createQuery creates the table from the column types, or the types of the values in row.
+func (s *Sqlite) createQuery(row RowProcessed) string {
+	columns := make([]string, len(s.columns))
+	for i, c := range s.columns {
+		t, ok := s.types[c]
+		if !ok {
+			t = valueType(row.Get(c))
+		}
+		columns[i] = fmt.Sprintf("%s %s", sqliteQuote(c), sqliteType(t))
+	}
+	if len(s.keyColumns) > 0 {
+		keys := make([]string, len(s.keyColumns))
+		for i, c := range s.keyColumns {
+			keys[i] = sqliteQuote(c)
+		}
+		columns = append(columns, fmt.Sprintf("primary key (%s)", strings.Join(keys, ", ")))
+	}
+	return fmt.Sprintf("create table if not exists %s (%s)", sqliteQuote(s.table), strings.Join(columns, ", "))
+}
+
+func (s *Sqlite) insertQuery() string {
+	verb := "insert"
+	switch s.mode {
+	case "insertIgnore":
+		verb = "insert or ignore"
+	case "replace":
+		verb = "insert or replace"
+	}
+
+	columns := make([]string, len(s.columns))
+	for i, c := range s.columns {
+		columns[i] = sqliteQuote(c)
+	}
+	return fmt.Sprintf("%s into %s (%s) values (%s)", verb, sqliteQuote(s.table), strings.Join(columns, ","), strings.TrimSuffix(strings.Repeat("?,", len(s.columns)), ","))
+}
+
+func sqliteQuote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// sqliteType returns the SQLite column type for a job column type.  Dates are stored as
+// text, which the driver reads back as time.Time for DATE columns.
+func sqliteType(t string) string {
+	switch t {
+	case "int", "bool":
+		return "INTEGER"
+	case "float":
+		return "REAL"
+	case "decimal":
+		return "NUMERIC"
+	case "date":
+		return "DATE"
+	}
+	return "TEXT"
+}
+
+// valueType returns the job column type of a processed value.
+func valueType(v interface{}) string {
+	switch v.(type) {
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case bool:
+		return "bool"
+	case Decimal:
+		return "decimal"
+	case time.Time:
+		return "date"
+	}
+	return "string"
+}
+
+// sqliteValue formats dates the way they are read, without the time when it is not set.
+func sqliteValue(v interface{}) interface{} {
+	if t, ok := v.(time.Time); ok {
+		return formatValue(t)
+	}
+	return v
+}
+
+func (s *Sqlite) Open() {
+	file, _ := s.Options["file"].(string)
+	if file == "" {
+		log.Fatal("SQLite output requires a file")
+	}
+	s.table, _ = s.Options["table"].(string)
+	if s.table == "" {
+		log.Fatal("SQLite output requires a table")
+	}
+	s.createTable, _ = s.Options["createTable"].(bool)
+	s.keyColumns = stringsOption(s.Options["keyColumns"])
+
+	s.mode, _ = s.Options["mode"].(string)
+	switch s.mode {
+	case "", "insert":
+	case "insertIgnore", "replace":
+		// A table created without a key never has a conflicting row
+		if s.createTable && len(s.keyColumns) == 0 {
+			log.Fatalf("SQLite mode %s requires keyColumns to create the table", s.mode)
+		}
+	default:
+		log.Fatalf("Unknown SQLite mode %s", s.mode)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), os.FileMode(0755)); err != nil {
+		log.Fatal(err)
+	}
+
+	var err error
+	if s.db, err = sql.Open("sqlite3", file); err != nil {
+		log.Fatal(err)
+	}
+	if s.tx, err = s.db.Begin(); err != nil {
+		log.Fatal(err)
+	}
+	log.WithFields(log.Fields{
+		"file":  file,
+		"table": s.table,
+	}).Info("Opened SQLite database")
+
+	// The table is created as soon as the columns are known, so jobs without rows create it
+	if s.createTable && s.columns != nil {
+		if _, err := s.tx.Exec(s.createQuery(NewRowProcessed())); err != nil {
+			log.Fatal("Unable to create table: ", err)
+		}
+	}
+
+	cleanup, _ := s.Options["cleanup"].(string)
+	switch cleanup {
+	case "":
+	case "truncate":
+		// Tables created from the first row do not exist yet
+		var n int
+		if err := s.tx.QueryRow("select count(*) from sqlite_master where type = 'table' and name = ?", s.table).Scan(&n); err != nil || n == 0 {
+			break
+		}
+		if _, err := s.tx.Exec(fmt.Sprintf("delete from %s", sqliteQuote(s.table))); err != nil {
+			log.Fatal("Unable to truncate table: ", err)
+		}
+	default:
+		log.Fatalf("Unknown SQLite cleanup %s", cleanup)
+	}
+}
+
+func (s *Sqlite) Close() {
+	if s.stmt != nil {
+		s.stmt.Close()
+	}
+	// The rows written in a transaction which fails to commit are lost
+	if err := s.tx.Commit(); err != nil {
+		s.failed += s.pending
+		log.Errorf("Failed to commit %d rows: %s", s.pending, err)
+	}
+	s.pending = 0
+	s.db.Close()
+
+	if s.failed > 0 {
+		log.Warnf("Failed to write %d rows to SQLite", s.failed)
+	}
+}
+
+func (s *Sqlite) Rollback() {
+	if s.stmt != nil {
+		s.stmt.Close()
+	}
+	if err := s.tx.Rollback(); err != nil {
+		log.Error("Failed to roll back: ", err)
+	}
+	s.db.Close()
+}
+
+// Failed is the number of rows which could not be written.
+func (s *Sqlite) Failed() uint {
+	return s.failed
+}
+
+func (s *Sqlite) String() string {
+	return "SQLite"
+}
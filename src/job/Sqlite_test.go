@@ -0,0 +1,156 @@
+// Copyright 2014 Aller Media AS.  All rights reserved.
+// License: GPL3
+package job
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSqliteQueries(t *testing.T) {
+	s := &Sqlite{
+		table:   "test",
+		columns: []string{"date", "valuta", "kurs"},
+		types:   map[string]string{"date": "date", "kurs": "decimal"},
+	}
+
+	row := NewRowProcessed()
+	row.Set("valuta", "EUR")
+	e := `create table if not exists "test" ("date" DATE, "valuta" TEXT, "kurs" NUMERIC)`
+	if q := s.createQuery(row); q != e {
+		t.Errorf("Expecting %s, got %s", e, q)
+	}
+
+	s.keyColumns = []string{"date", "valuta"}
+	e = `create table if not exists "test" ("date" DATE, "valuta" TEXT, "kurs" NUMERIC, primary key ("date", "valuta"))`
+	if q := s.createQuery(row); q != e {
+		t.Errorf("Expecting %s, got %s", e, q)
+	}
+
+	data := []struct {
+		mode string
+		e    string
+	}{
+		{"", `insert into "test" ("date","valuta","kurs") values (?,?,?)`},
+		{"insertIgnore", `insert or ignore into "test" ("date","valuta","kurs") values (?,?,?)`},
+		{"replace", `insert or replace into "test" ("date","valuta","kurs") values (?,?,?)`},
+	}
+	for _, d := range data {
+		s.mode = d.mode
+		if q := s.insertQuery(); q != d.e {
+			t.Errorf("%s: expecting %s, got %s", d.mode, d.e, q)
+		}
+	}
+}
+
+func TestSqliteWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "test.db")
+
+	row := func(valuta string, kurs float64) RowProcessed {
+		r := NewRowProcessed()
+		r.Set("date", time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC))
+		r.Set("valuta", valuta)
+		r.Set("kurs", kurs)
+		return r
+	}
+	write := func(options map[string]interface{}, rows ...RowProcessed) *Sqlite {
+		options["file"] = file
+		if options["table"] == nil {
+			options["table"] = "currencies"
+		}
+		s := &Sqlite{Options: options}
+		s.Open()
+		for _, r := range rows {
+			s.Write(r)
+		}
+		return s
+	}
+
+	// Created from the values of the first row
+	write(map[string]interface{}{"createTable": true}, row("EUR", 8.1), row("USD", 6.1)).Close()
+	// Rolled back
+	write(map[string]interface{}{}, row("SEK", 0.9)).Rollback()
+	write(map[string]interface{}{}, row("DKK", 1.1)).Close()
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var kind string
+	var n int
+	if err := db.QueryRow("select typeof(kurs), count(*) from currencies").Scan(&kind, &n); err != nil {
+		t.Fatal(err)
+	}
+	if kind != "real" || n != 3 {
+		t.Errorf("Expecting 3 real values, got %d %s", n, kind)
+	}
+
+	var date, valuta string
+	var kurs float64
+	if err := db.QueryRow("select cast(date as text), valuta, kurs from currencies where valuta = 'EUR'").Scan(&date, &valuta, &kurs); err != nil {
+		t.Fatal(err)
+	}
+	if date != "2014-01-01" || valuta != "EUR" || kurs != 8.1 {
+		t.Errorf("Expecting 2014-01-01 EUR 8.1, got %s %s %v", date, valuta, kurs)
+	}
+
+	write(map[string]interface{}{"cleanup": "truncate"}, row("SEK", 0.9)).Close()
+	if err := db.QueryRow("select count(*) from currencies").Scan(&n); err != nil || n != 1 {
+		t.Errorf("Expecting 1 row, got %d %v", n, err)
+	}
+
+	// Replaced by the key the table was created with
+	keyed := map[string]interface{}{"table": "keyed", "createTable": true, "keyColumns": []interface{}{"date", "valuta"}, "mode": "replace"}
+	write(keyed, row("EUR", 8.1), row("EUR", 8.2)).Close()
+	if err := db.QueryRow("select count(*), max(kurs) from keyed").Scan(&n, &kurs); err != nil || n != 1 || kurs != 8.2 {
+		t.Errorf("Expecting 1 replaced row, got %d %v %v", n, kurs, err)
+	}
+
+	// A row with a duplicate key is saved with its error
+	rejects, err := NewOutputRejects("test-sqlite-rejects", "ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(rejects.Path()))
+	s := &Sqlite{Options: map[string]interface{}{"file": file, "table": "keyed"}}
+	s.SetRejects(rejects)
+	s.Open()
+	s.Write(row("EUR", 8.3))
+	s.Write(row("USD", 6.1))
+	s.Close()
+	rejects.Close()
+	b, _ := ioutil.ReadFile(rejects.Path())
+	if s.Failed() != 1 || !strings.Contains(string(b), `"valuta":"EUR"`) || !strings.Contains(string(b), "UNIQUE constraint failed") {
+		t.Errorf("Expecting the EUR row in the rejects, got %d failed and %s", s.Failed(), b)
+	}
+
+	// The rows of a transaction which fails to commit have failed
+	s = write(map[string]interface{}{}, row("NOK", 1), row("GBP", 10))
+	s.tx.Rollback()
+	s.Close()
+	if s.Failed() != 2 {
+		t.Errorf("Expecting 2 failed rows, got %d", s.Failed())
+	}
+
+	// Created from the job's columns, even without rows
+	s = &Sqlite{Options: map[string]interface{}{"file": file, "table": "empty", "createTable": true}}
+	s.SetColumns([]string{"id"})
+	s.SetColumnTypes(map[string]string{"id": "int"})
+	s.Open()
+	s.Close()
+	if err := db.QueryRow("select count(*) from empty").Scan(&n); err != nil || n != 0 {
+		t.Errorf("Expecting an empty table, got %d %v", n, err)
+	}
+}
@@ -9,40 +9,90 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/tbruyelle/hipchat-go/hipchat"
+	"sort"
+	"strings"
 	"time"
 )
 
+const (
+	StatusOK     = "OK"
+	StatusFailed = "FAILED"
+)
+
 type Notifier interface {
 	Notify(Message)
 }
 
 type Message struct {
-	Jobname   string
-	Status    string
-	TimeTaken time.Duration
-	Rows      uint
-	Accepted  uint
-	Rejected  uint
+	Jobname    string
+	Status     string
+	Error      string
+	TimeTaken  time.Duration
+	Rows       uint
+	Accepted   uint
+	Filtered   uint
+	Duplicates uint
+	Rejected   uint
+	// Invalid fields kept, by "column (failure policy)"
+	Kept map[string]uint
+	// Rows the output failed to write, and by output when there are several
+	Failed        uint
+	FailedOutputs map[string]uint
 }
 
 func (m Message) String() string {
-	return fmt.Sprintf("%s: processed %d rows; accepted %d and rejected %d in %s", m.Jobname, m.Rows, m.Accepted, m.Rejected, m.TimeTaken)
+	s := fmt.Sprintf("%s: processed %d rows; accepted %d, filtered %d, duplicates %d and rejected %d in %s", m.Jobname, m.Rows, m.Accepted, m.Filtered, m.Duplicates, m.Rejected, m.TimeTaken)
+	if m.Failed > 0 {
+		s = fmt.Sprintf("%s; failed to write %d", s, m.Failed)
+		outputs := make([]string, 0, len(m.FailedOutputs))
+		for k, v := range m.FailedOutputs {
+			if v > 0 {
+				outputs = append(outputs, fmt.Sprintf("%s %d", k, v))
+			}
+		}
+		if len(outputs) > 0 {
+			sort.Strings(outputs)
+			s = fmt.Sprintf("%s (%s)", s, strings.Join(outputs, ", "))
+		}
+	}
+	if len(m.Kept) > 0 {
+		kept := make([]string, 0, len(m.Kept))
+		for k, v := range m.Kept {
+			kept = append(kept, fmt.Sprintf("%s %d", k, v))
+		}
+		sort.Strings(kept)
+		s = fmt.Sprintf("%s; kept invalid fields: %s", s, strings.Join(kept, ", "))
+	}
+	if m.Status != StatusOK {
+		s = fmt.Sprintf("%s [%s: %s]", s, m.Status, m.Error)
+	}
+	return s
 }
 
 type HipChat struct {
 	Token string
 	Room  string
+
+	// Only notify when a job fails
+	FailureOnly bool
 }
 
 func (h *HipChat) Notify(msg Message) {
+	failed := msg.Status != StatusOK
+	if h.FailureOnly && !failed {
+		return
+	}
+
 	c := hipchat.NewClient(h.Token)
 
 	// https://www.hipchat.com/docs/apiv2/method/send_room_notification
 	nr := &hipchat.NotificationRequest{
 		Message: msg.String(),
-		// Update info here based on what type of notify message we have (status)
-		Notify: false, // Send desktop notification
-		Color:  "green",
+		Notify:  failed, // Send desktop notification
+		Color:   "green",
+	}
+	if failed {
+		nr.Color = "red"
 	}
 
 	_, err := c.Room.Notification(h.Room, nr)
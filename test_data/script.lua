@@ -0,0 +1,15 @@
+-- Test script: splits orders into one row per item, rejects cancelled orders
+function process(row, raw)
+  if raw.status == "cancelled" then
+    return nil, "order cancelled"
+  end
+  if row.amount == nil then
+    return nil
+  end
+
+  local rows = {}
+  for item in string.gmatch(raw.items, "[^,]+") do
+    table.insert(rows, {id = row.id, amount = row.amount * 2, item = item, vip = row.amount > 100})
+  end
+  return rows
+end